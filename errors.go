@@ -0,0 +1,105 @@
+package fatfs
+
+import (
+	"errors"
+	"io/fs"
+	"strconv"
+)
+
+/* File function return codes (FRESULT) not already defined by fatfs.go */
+const (
+	FR_NO_SPACE = 20 /* (20) No free cluster left on the volume, FatFs reports this as FR_DENIED */
+)
+
+// ErrNoSpace is returned when an operation needs to allocate clusters on a
+// volume that has none left.
+var ErrNoSpace = errors.New("no space left on volume")
+
+var frStrings = [...]struct{ name, desc string }{
+	FR_OK:                  {"FR_OK", "succeeded"},
+	FR_DISK_ERR:            {"FR_DISK_ERR", "hard error in low level disk I/O layer"},
+	FR_INT_ERR:             {"FR_INT_ERR", "assertion failed"},
+	FR_NOT_READY:           {"FR_NOT_READY", "physical drive not ready"},
+	FR_NO_FILE:             {"FR_NO_FILE", "file not found"},
+	FR_NO_PATH:             {"FR_NO_PATH", "path not found"},
+	FR_INVALID_NAME:        {"FR_INVALID_NAME", "invalid path name format"},
+	FR_DENIED:              {"FR_DENIED", "access denied or directory full"},
+	FR_EXIST:               {"FR_EXIST", "object already exists"},
+	FR_INVALID_OBJECT:      {"FR_INVALID_OBJECT", "invalid file or directory object"},
+	FR_WRITE_PROTECTED:     {"FR_WRITE_PROTECTED", "physical drive is write protected"},
+	FR_INVALID_DRIVE:       {"FR_INVALID_DRIVE", "invalid logical drive number"},
+	FR_NOT_ENABLED:         {"FR_NOT_ENABLED", "volume has no work area"},
+	FR_NO_FILESYSTEM:       {"FR_NO_FILESYSTEM", "no valid FAT volume"},
+	FR_MKFS_ABORTED:        {"FR_MKFS_ABORTED", "format aborted"},
+	FR_TIMEOUT:             {"FR_TIMEOUT", "timed out waiting for volume access"},
+	FR_LOCKED:              {"FR_LOCKED", "rejected by file sharing policy"},
+	FR_NOT_ENOUGH_CORE:     {"FR_NOT_ENOUGH_CORE", "LFN working buffer could not be allocated"},
+	FR_TOO_MANY_OPEN_FILES: {"FR_TOO_MANY_OPEN_FILES", "too many open files"},
+	FR_INVALID_PARAMETER:   {"FR_INVALID_PARAMETER", "invalid parameter"},
+	FR_NO_SPACE:            {"FR_NO_SPACE", "no space left on volume"},
+}
+
+// String returns the name of the result code, i.e: "FR_NO_FILE".
+func (fr FRESULT) String() string {
+	if fr >= 0 && int(fr) < len(frStrings) {
+		return frStrings[fr].name
+	}
+	return "FRESULT(" + strconv.Itoa(int(fr)) + ")"
+}
+
+// Error records a failed FatFs operation along with the path it acted upon,
+// in the manner of [fs.PathError]. It unwraps to the io/fs sentinel matching
+// its result code so callers can test it with [errors.Is]:
+//
+//	FR_NO_FILE, FR_NO_PATH        fs.ErrNotExist
+//	FR_EXIST                      fs.ErrExist
+//	FR_DENIED, FR_WRITE_PROTECTED fs.ErrPermission
+//	FR_INVALID_OBJECT             fs.ErrClosed
+//	FR_INVALID_NAME/PARAMETER     fs.ErrInvalid
+//	FR_NO_SPACE                   ErrNoSpace
+type Error struct {
+	Op   string
+	Path string
+	Code FRESULT
+}
+
+// newError returns nil if fr is FR_OK and an *Error otherwise.
+func newError(op, path string, fr FRESULT) error {
+	if fr == FR_OK {
+		return nil
+	}
+	return &Error{Op: op, Path: path, Code: fr}
+}
+
+func (e *Error) Error() string {
+	msg := e.Code.String()
+	if e.Code >= 0 && int(e.Code) < len(frStrings) {
+		msg = frStrings[e.Code].desc
+	}
+	if e.Path == "" {
+		return e.Op + ": " + msg
+	}
+	return e.Op + " " + e.Path + ": " + msg
+}
+
+// Unwrap returns the sentinel error matching the result code, or nil if there is none.
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case FR_NO_FILE, FR_NO_PATH:
+		return fs.ErrNotExist
+	case FR_EXIST:
+		return fs.ErrExist
+	case FR_DENIED, FR_WRITE_PROTECTED:
+		return fs.ErrPermission
+	case FR_INVALID_OBJECT:
+		return fs.ErrClosed
+	case FR_INVALID_NAME, FR_INVALID_PARAMETER:
+		return fs.ErrInvalid
+	case FR_NO_SPACE:
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// Timeout reports whether the operation failed to acquire the volume in time.
+func (e *Error) Timeout() bool { return e.Code == FR_TIMEOUT }
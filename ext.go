@@ -1,7 +1,13 @@
 package fatfs
 
 import (
+	"math"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"modernc.org/libc"
@@ -9,40 +15,183 @@ import (
 
 const enablePinning = true
 
-var pins runtime.Pinner
+// volumesMu serializes changes to the volume table and the current drive.
+var volumesMu sync.Mutex
 
-func Mount(tls *libc.TLS, fs *FATFS, path string, opt byte) FRESULT {
+// driveTLS is the thread state Chdrive calls into FatFs with, created on
+// first use and guarded by volumesMu.
+var driveTLS *libc.TLS
+
+// volumeTable is the runtime-sized replacement of the FatFs and VolumeStr
+// arrays. The logical drive number of a volume is its index in the table.
+// The table is copied on every change so lookups need no locking.
+var volumeTable atomic.Pointer[[]volume]
+
+type volume struct {
+	id string  /* Volume ID without the colon, i.e: "sd" */
+	fs uintptr /* Filesystem object registered with f_mount */
+}
+
+// volume_number returns the logical drive number of the volume with the
+// given ID, compared case insensitively, or -1 if there is none.
+func volume_number(id string) int32 {
+	if table := volumeTable.Load(); table != nil {
+		for i, v := range *table {
+			if v.id != "" && strings.EqualFold(v.id, id) {
+				return int32(i)
+			}
+		}
+	}
+	return -1
+}
+
+// volume_fs returns the filesystem object registered for logical drive vol.
+func volume_fs(vol int32) uintptr {
+	table := volumeTable.Load()
+	if table == nil || int(vol) >= len(*table) {
+		return 0
+	}
+	return (*table)[vol].fs
+}
+
+// set_volume_fs registers fs for logical drive vol. volumesMu must be held.
+func set_volume_fs(vol int32, fs uintptr) {
+	table := slices.Clone(*volumeTable.Load())
+	table[vol].fs = fs
+	volumeTable.Store(&table)
+}
+
+// addVolume reserves a logical drive for the volume ID and returns its
+// number. volumesMu must be held.
+func addVolume(id string) (int32, FRESULT) {
+	if volume_number(id) >= 0 {
+		return -1, FR_EXIST
+	}
+	var table []volume
+	if t := volumeTable.Load(); t != nil {
+		table = slices.Clone(*t)
+	}
+	vol := slices.IndexFunc(table, func(v volume) bool { return v.id == "" })
+	if vol < 0 {
+		if len(table) > math.MaxUint8 {
+			return -1, FR_INVALID_DRIVE // Drive numbers are stored in a BYTE.
+		}
+		vol = len(table)
+		table = append(table, volume{})
+	}
+	table[vol] = volume{id: id}
+	volumeTable.Store(&table)
+	return int32(vol), FR_OK
+}
+
+// removeVolume frees the logical drive of an unregistered volume. volumesMu must be held.
+func removeVolume(vol int32) {
+	table := slices.Clone(*volumeTable.Load())
+	table[vol] = volume{}
+	volumeTable.Store(&table)
+}
+
+// fsidMu guards Fsid, which volumes bump on mount from their own goroutines.
+var fsidMu sync.Mutex
+
+// next_fsid returns a new filesystem mount ID.
+func next_fsid() WORD {
+	fsidMu.Lock()
+	defer fsidMu.Unlock()
+	Fsid++
+	return Fsid
+}
+
+// BlockDevice is the physical drive that hosts a FAT volume. Blocks are
+// addressed by sector number and are SectorSize bytes long.
+type BlockDevice interface {
+	// ReadBlocks reads len(dst)/SectorSize() sectors starting at startBlock into dst.
+	ReadBlocks(dst []byte, startBlock int64) (int, error)
+	// WriteBlocks writes len(data)/SectorSize() sectors starting at startBlock.
+	WriteBlocks(data []byte, startBlock int64) (int, error)
+	// Sync flushes any data cached by the device to the underlying storage.
+	Sync() error
+	// SectorCount returns the number of sectors available on the device.
+	SectorCount() int64
+	// SectorSize returns the size in bytes of a single sector.
+	SectorSize() int
+	// Status returns the device status as a combination of STA_* flags.
+	// A device that is ready for use returns 0.
+	Status() DSTATUS
+}
+
+// EraseBlocker is implemented by a [BlockDevice] on flash media that knows
+// its erase block size. [Format] aligns the data area to it unless
+// [FormatOptions] sets Align, as f_mkfs does with GET_BLOCK_SIZE.
+type EraseBlocker interface {
+	// EraseBlockSize returns the erase block size in sectors, a power of two
+	// up to 32768. Other values, like 0 for unknown, select 1.
+	EraseBlockSize() int
+}
+
+/* Disk Status Bits (DSTATUS) not already defined by fatfs.go */
+const (
+	STA_NODISK = 2 /* No medium in the drive */
+)
+
+/* Command code for disk_ioctrl fucntion not already defined by fatfs.go */
+const (
+	GET_SECTOR_COUNT = 1 /* Get media size (needed at FF_USE_MKFS == 1) */
+	GET_SECTOR_SIZE  = 2 /* Get sector size (needed at FF_MAX_SS != FF_MIN_SS) */
+	GET_BLOCK_SIZE   = 3 /* Get erase block size (needed at FF_USE_MKFS == 1) */
+)
+
+/* Fast seek controls (2nd argument of f_lseek) */
+const (
+	CREATE_LINKMAP = math.MaxUint64 /* Create a cluster link map table (needed at FF_USE_FASTSEEK == 1) */
+)
+
+// mount registers the filesystem object of fsys as the one of the logical drive
+// in path and binds it to dev, which from then on serves every sector access to the volume.
+func (fsys *FS) mount(dev BlockDevice, path string, opt byte) FRESULT {
+	if dev == nil {
+		return FR_INVALID_PARAMETER
+	}
 	if enablePinning {
-		pins.Pin(fs)
+		var pins runtime.Pinner
+		pins.Pin(&fsys.fs)
 		defer pins.Unpin()
 	}
-	_fs := (uintptr)(unsafe.Pointer(fs))
+	fsys.fs.dev = dev
+	_fs := (uintptr)(unsafe.Pointer(&fsys.fs))
 	_path, _ := libc.CString(path)
-
-	return f_mount(tls, _fs, _path, opt)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_mount(fsys.tls, _fs, _path, opt)
 }
 
-func Open(tls *libc.TLS, fp *FIL, path string, mode uint8) FRESULT {
+func (fsys *FS) open(fp *FIL, path string, mode uint8) FRESULT {
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(fp)
 		defer pins.Unpin()
 	}
 	_fp := (uintptr)(unsafe.Pointer(fp))
 	_path, _ := libc.CString(path)
-	return f_open(tls, _fp, _path, mode)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_open(fsys.tls, _fp, _path, mode)
 }
 
-func Close(tls *libc.TLS, fp *FIL) FRESULT {
+func (fsys *FS) close(fp *FIL) FRESULT {
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(fp)
 		defer pins.Unpin()
 	}
 	_fp := (uintptr)(unsafe.Pointer(fp))
-	return f_close(tls, _fp)
+	return f_close(fsys.tls, _fp)
 }
 
-func Read(tls *libc.TLS, fp *FIL, buf []byte) (n int, fr FRESULT) {
+func (fsys *FS) read(fp *FIL, buf []byte) (n int, fr FRESULT) {
+	if len(buf) == 0 {
+		return 0, FR_OK
+	}
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(fp)
 		pins.Pin(&buf[0])
 		pins.Pin(&n)
@@ -51,12 +200,16 @@ func Read(tls *libc.TLS, fp *FIL, buf []byte) (n int, fr FRESULT) {
 	_fp := (uintptr)(unsafe.Pointer(fp))
 	_buf := (uintptr)(unsafe.Pointer(&buf[0]))
 	_br := (uintptr)(unsafe.Pointer(&n))
-	fr = f_read(tls, _fp, _buf, uint32(len(buf)), _br)
+	fr = f_read(fsys.tls, _fp, _buf, uint32(len(buf)), _br)
 	return n, fr
 }
 
-func Write(tls *libc.TLS, fp *FIL, buf []byte) (n int, fr FRESULT) {
+func (fsys *FS) write(fp *FIL, buf []byte) (n int, fr FRESULT) {
+	if len(buf) == 0 {
+		return 0, FR_OK
+	}
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(fp)
 		pins.Pin(&buf[0])
 		pins.Pin(&n)
@@ -65,206 +218,538 @@ func Write(tls *libc.TLS, fp *FIL, buf []byte) (n int, fr FRESULT) {
 	_fp := (uintptr)(unsafe.Pointer(fp))
 	_buf := (uintptr)(unsafe.Pointer(&buf[0]))
 	_bw := (uintptr)(unsafe.Pointer(&n))
-	fr = f_write(tls, _fp, _buf, uint32(len(buf)), _bw)
+	fr = f_write(fsys.tls, _fp, _buf, uint32(len(buf)), _bw)
 	return n, fr
 }
 
-func Sync(tls *libc.TLS, fp *FIL) FRESULT {
+func (fsys *FS) sync(fp *FIL) FRESULT {
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(fp)
 		defer pins.Unpin()
 	}
 	_fp := (uintptr)(unsafe.Pointer(fp))
-	return f_sync(tls, _fp)
+	return f_sync(fsys.tls, _fp)
 }
 
-func OpenDir(tls *libc.TLS, dp *DIR, path string) FRESULT {
+func (fsys *FS) opendir(dp *DIR, path string) FRESULT {
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(dp)
 		defer pins.Unpin()
 	}
 	_dp := (uintptr)(unsafe.Pointer(dp))
 	_path, _ := libc.CString(path)
-	return f_opendir(tls, _dp, _path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_opendir(fsys.tls, _dp, _path)
 }
 
-func ReadDir(tls *libc.TLS, dp *DIR, fno *FILINFO) (fr FRESULT) {
+func (fsys *FS) readdir(dp *DIR, fno *FILINFO) (fr FRESULT) {
 	if enablePinning {
+		var pins runtime.Pinner
 		pins.Pin(dp)
 		pins.Pin(fno)
 		defer pins.Unpin()
 	}
 	_dp := (uintptr)(unsafe.Pointer(dp))
 	_fno := (uintptr)(unsafe.Pointer(fno))
-	fr = f_readdir(tls, _dp, _fno)
+	fr = f_readdir(fsys.tls, _dp, _fno)
 	return fr
 }
 
-var RAM_disk_read = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 1
+// setcp sets the OEM code page the volume of fsys converts short file names
+// and the volume label with.
+func (fsys *FS) setcp(cp WORD) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(&fsys.fs)
+		defer pins.Unpin()
+	}
+	_fs := (uintptr)(unsafe.Pointer(&fsys.fs))
+	return f_setcp(fsys.tls, _fs, cp)
 }
 
-var MMC_disk_read = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 0
+// unmount unregisters the filesystem object of the logical drive in path.
+func (fsys *FS) unmount(path string) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_mount(fsys.tls, 0, _path, 0)
 }
 
-var USB_disk_read = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 0
+func (fsys *FS) lseek(fp *FIL, ofs FSIZE_t) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		defer pins.Unpin()
+	}
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	return f_lseek(fsys.tls, _fp, ofs)
 }
 
-var RAM_disk_write = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 0
+func (fsys *FS) truncate(fp *FIL) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		defer pins.Unpin()
+	}
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	return f_truncate(fsys.tls, _fp)
 }
 
-var MMC_disk_write = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 0
+// linkmap switches fp to fast seek mode with a cluster link map table of size
+// items allocated on the C heap, replacing any previous one. It returns the
+// number of items the file needs. On failure fp is left in normal seek mode.
+func (fsys *FS) linkmap(fp *FIL, size int) (int, FRESULT) {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		defer pins.Unpin()
+	}
+	fsys.droplinkmap(fp)
+	tbl := libc.Xmalloc(fsys.tls, uint64(max(size, 1))*4)
+	if tbl == 0 {
+		return 0, FR_NOT_ENOUGH_CORE
+	}
+	*(*DWORD)(unsafe.Pointer(tbl)) = DWORD(size)
+	fp.cltbl = tbl
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	fr := f_lseek(fsys.tls, _fp, CREATE_LINKMAP)
+	need := int(*(*DWORD)(unsafe.Pointer(tbl)))
+	if fr != FR_OK {
+		fsys.droplinkmap(fp)
+	}
+	return need, fr
 }
 
-var USB_disk_write = func(tls *libc.TLS, buf uintptr, sector LBA_t, count UINT) (r int32) {
-	return 0
+func (fsys *FS) expand(fp *FIL, size FSIZE_t, opt BYTE) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		defer pins.Unpin()
+	}
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	return f_expand(fsys.tls, _fp, size, opt)
 }
 
-var RAM_disk_initialize = func(tls *libc.TLS) (r int32) {
-	return 0
+// forward streams up to btf bytes of fp to fn straight from the sector
+// buffer of fp. fn is called with an empty slice to check it is ready.
+func (fsys *FS) forward(fp *FIL, fn func(p []byte) int, btf uint32) (n int, fr FRESULT) {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		pins.Pin(&n)
+		defer pins.Unpin()
+	}
+	stream := func(tls *libc.TLS, buf uintptr, btf UINT) UINT {
+		if btf == 0 {
+			return UINT(fn(nil))
+		}
+		n := fn(bytesAt(buf, int(btf)))
+		return UINT(min(max(n, 0), int(btf)))
+	}
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	_bf := (uintptr)(unsafe.Pointer(&n))
+	fr = f_forward(fsys.tls, _fp, stream, btf, _bf)
+	return n, fr
 }
 
-var MMC_disk_initialize = func(tls *libc.TLS) (r int32) {
-	return 0
+// droplinkmap returns fp to normal seek mode and frees its link map table.
+func (fsys *FS) droplinkmap(fp *FIL) {
+	if fp.cltbl != 0 {
+		libc.Xfree(fsys.tls, fp.cltbl)
+		fp.cltbl = 0
+	}
 }
 
-var USB_disk_initialize = func(tls *libc.TLS) (r int32) {
-	return 0
+// findfirst opens the directory in path and reads its first entry matching
+// pattern, a C string that must stay allocated until dp is closed.
+func (fsys *FS) findfirst(dp *DIR, fno *FILINFO, path string, pattern uintptr) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(dp)
+		pins.Pin(fno)
+		defer pins.Unpin()
+	}
+	_dp := (uintptr)(unsafe.Pointer(dp))
+	_fno := (uintptr)(unsafe.Pointer(fno))
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_findfirst(fsys.tls, _dp, _fno, _path, pattern)
 }
 
-var RAM_disk_status = func(tls *libc.TLS) (r int32) {
-	return 0
+func (fsys *FS) findnext(dp *DIR, fno *FILINFO) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(dp)
+		pins.Pin(fno)
+		defer pins.Unpin()
+	}
+	_dp := (uintptr)(unsafe.Pointer(dp))
+	_fno := (uintptr)(unsafe.Pointer(fno))
+	return f_findnext(fsys.tls, _dp, _fno)
 }
 
-var MMC_disk_status = func(tls *libc.TLS) (r int32) {
-	return 0
+func (fsys *FS) closedir(dp *DIR) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(dp)
+		defer pins.Unpin()
+	}
+	_dp := (uintptr)(unsafe.Pointer(dp))
+	return f_closedir(fsys.tls, _dp)
 }
 
-var USB_disk_status = func(tls *libc.TLS) (r int32) {
-	return 0
+func (fsys *FS) stat(path string, fno *FILINFO) FRESULT {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fno)
+		defer pins.Unpin()
+	}
+	_fno := (uintptr)(unsafe.Pointer(fno))
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_stat(fsys.tls, _path, _fno)
+}
+
+// fstat fills fno from the directory entry of the open file fp, wherever
+// the file was opened from. FAT entries read this way carry only the short
+// name; exFAT ones carry the full name.
+//
+//go:nocheckptr
+func (fsys *FS) fstat(fp *FIL, fno *FILINFO) FRESULT {
+	var fs uintptr
+	var dj DIR
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fp)
+		pins.Pin(fno)
+		pins.Pin(&fs)
+		pins.Pin(&dj)
+		defer pins.Unpin()
+	}
+	_fp := (uintptr)(unsafe.Pointer(fp))
+	_dj := (uintptr)(unsafe.Pointer(&dj))
+	fr := validate(fsys.tls, _fp, (uintptr)(unsafe.Pointer(&fs)))
+	if fr != FR_OK {
+		return fr
+	}
+	if (*FATFS)(unsafe.Pointer(fs)).fs_type == FS_EXFAT {
+		fr = load_obj_xdir(fsys.tls, _dj, _fp)
+	} else {
+		fr = move_window(fsys.tls, fs, fp.dir_sect)
+		dj.obj.fs, dj.sect, dj.dir, dj.blk_ofs = fs, fp.dir_sect, fp.dir_ptr, 0xFFFFFFFF
+	}
+	if fr != FR_OK {
+		return fr
+	}
+	get_fileinfo(fsys.tls, _dj, (uintptr)(unsafe.Pointer(fno)))
+	return FR_OK
+}
+
+func (fsys *FS) unlink(path string) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_unlink(fsys.tls, _path)
+}
+
+func (fsys *FS) mkdir(path string) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_mkdir(fsys.tls, _path)
+}
+
+func (fsys *FS) rename(oldpath, newpath string) FRESULT {
+	_oldpath, _ := libc.CString(oldpath)
+	defer libc.Xfree(fsys.tls, _oldpath)
+	_newpath, _ := libc.CString(newpath)
+	defer libc.Xfree(fsys.tls, _newpath)
+	return f_rename(fsys.tls, _oldpath, _newpath)
+}
+
+func (fsys *FS) chmod(path string, attr, mask BYTE) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_chmod(fsys.tls, _path, attr, mask)
+}
+
+func (fsys *FS) chdir(path string) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_chdir(fsys.tls, _path)
+}
+
+// getlabel returns the label and serial number of the volume in path.
+func (fsys *FS) getlabel(path string) (label string, vsn uint32, fr FRESULT) {
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(&vsn)
+		defer pins.Unpin()
+	}
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	_label := libc.Xcalloc(fsys.tls, 1, 11*4+1) // Up to 11 characters of 4 bytes in UTF-8.
+	defer libc.Xfree(fsys.tls, _label)
+	fr = f_getlabel(fsys.tls, _path, _label, (uintptr)(unsafe.Pointer(&vsn)))
+	if fr != FR_OK {
+		return "", 0, fr
+	}
+	return gostring(_label), vsn, FR_OK
+}
+
+// setlabel sets the label of the volume selected by the drive prefix of label.
+func (fsys *FS) setlabel(label string) FRESULT {
+	_label, _ := libc.CString(label)
+	defer libc.Xfree(fsys.tls, _label)
+	return f_setlabel(fsys.tls, _label)
+}
+
+// getcwd returns the current directory of the volume selected by the drive
+// prefix vol, i.e: "sd:/dir/sub". The buffer grows until the path fits.
+func (fsys *FS) getcwd(vol string) (string, FRESULT) {
+	for size := FF_MAX_LFN + 1; ; size *= 2 {
+		buff := libc.Xcalloc(fsys.tls, 1, uint64(size))
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(buff)), size), vol)
+		fr := f_getcwd(fsys.tls, buff, UINT(size))
+		cwd := gostring(buff)
+		libc.Xfree(fsys.tls, buff)
+		if fr != FR_NOT_ENOUGH_CORE {
+			return cwd, fr
+		}
+	}
+}
+
+func (fsys *FS) utime(path string, mtime, crtime DWORD, crtime10 BYTE, acdate WORD) FRESULT {
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	return f_utime(fsys.tls, _path, mtime, crtime, crtime10, acdate)
 }
 
-var get_fattime = func(tls *libc.TLS) (r DWORD) {
-	return uint32(0)
+// getfree returns the number of free clusters on the volume in path and
+// the size in bytes of each cluster.
+//
+//go:nocheckptr
+func (fsys *FS) getfree(path string) (nclst uint32, clusterSize uint32, fr FRESULT) {
+	var _fs uintptr
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(&nclst)
+		pins.Pin(&_fs)
+		defer pins.Unpin()
+	}
+	_path, _ := libc.CString(path)
+	defer libc.Xfree(fsys.tls, _path)
+	fr = f_getfree(fsys.tls, _path, (uintptr)(unsafe.Pointer(&nclst)), (uintptr)(unsafe.Pointer(&_fs)))
+	if fr != FR_OK {
+		return 0, 0, fr
+	}
+	fs := (*FATFS)(unsafe.Pointer(_fs))
+	return nclst, uint32(fs.csize) * uint32(fs.ssize), FR_OK
+}
+
+/*-----------------------------------------------------------------------*/
+/* Get current time                                                      */
+/*-----------------------------------------------------------------------*/
+//go:nocheckptr
+func get_fattime(tls *libc.TLS, fs uintptr) (r DWORD) {
+	clock := (*FATFS)(unsafe.Pointer(fs)).clock
+	if clock == nil {
+		return fattime(time.Now())
+	}
+	return fattime(clock())
+}
+
+var (
+	minFATTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxFATTime = time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC)
+)
+
+// fattime packs the wall clock of t in its own location into a FAT timestamp:
+// the date in the upper 16 bits and the time, with 2 second resolution, in the
+// lower 16 bits. Dates outside of 1980 through 2107 are clamped to that range.
+func fattime(t time.Time) DWORD {
+	// Compare wall clocks, which is what FAT stores, regardless of location.
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	if wall.Before(minFATTime) {
+		wall = minFATTime
+	} else if wall.After(maxFATTime) {
+		wall = maxFATTime
+	}
+	return DWORD(wall.Year()-1980)<<25 | DWORD(wall.Month())<<21 | DWORD(wall.Day())<<16 |
+		DWORD(wall.Hour())<<11 | DWORD(wall.Minute())<<5 | DWORD(wall.Second()/2)
+}
+
+// fatRound returns the wall clock of t, taken as UTC, rounded to the nearest
+// multiple of d. Rounding the wall clock rather than the instant carries into
+// the minutes, hours and date as FAT counts them, ahead of fattime's clamping.
+func fatRound(t time.Time, d time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).Round(d)
+}
+
+// fattime10 returns the hundredths of a second t is past the 2 second
+// resolution of fattime, as kept in DIR_CrtTime10. Clamped times have none.
+func fattime10(t time.Time) BYTE {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	if wall.Before(minFATTime) || wall.After(maxFATTime) {
+		return 0
+	}
+	return BYTE(t.Second()%2*100 + t.Nanosecond()/1e7)
+}
+
+// fatTimeIn unpacks a FAT date and time as a wall clock in loc.
+func fatTimeIn(fdate, ftime WORD, loc *time.Location) time.Time {
+	d, t := int(fdate), int(ftime)
+	return time.Date(1980+d>>9, time.Month(d>>5&0xf), d&0x1f, t>>11, t>>5&0x3f, t&0x1f*2, 0, loc)
 }
 
 /*-----------------------------------------------------------------------*/
 /* Get Drive Status                                                      */
 /*-----------------------------------------------------------------------*/
-func disk_status(tls *libc.TLS, pdrv BYTE) (r DSTATUS) {
-	var result int32
-	var stat DSTATUS
-	_, _ = result, stat
-	switch int32(int32(pdrv)) {
-	case DEV_RAM:
-		result = RAM_disk_status(tls)
-		// translate the reslut code here
-		return stat
-	case int32(DEV_MMC):
-		result = MMC_disk_status(tls)
-		// translate the reslut code here
-		return stat
-	case int32(DEV_USB):
-		result = USB_disk_status(tls)
-		// translate the reslut code here
-		return stat
-	}
-	return uint8(STA_NOINIT)
+//go:nocheckptr
+func disk_status(tls *libc.TLS, fs uintptr) (r DSTATUS) {
+	dev := (*FATFS)(unsafe.Pointer(fs)).dev
+	if dev == nil {
+		return STA_NOINIT | STA_NODISK
+	}
+	return dev.Status()
 }
 
 /*-----------------------------------------------------------------------*/
 /* Inidialize a Drive                                                    */
 /*-----------------------------------------------------------------------*/
-func disk_initialize(tls *libc.TLS, pdrv BYTE) (r DSTATUS) {
-	var result int32
-	var stat DSTATUS
-	_, _ = result, stat
-	switch int32(int32(pdrv)) {
-	case DEV_RAM:
-		result = RAM_disk_initialize(tls)
-		// translate the reslut code here
-		return stat
-	case int32(DEV_MMC):
-		result = MMC_disk_initialize(tls)
-		// translate the reslut code here
-		return stat
-	case int32(DEV_USB):
-		result = USB_disk_initialize(tls)
-		// translate the reslut code here
-		return stat
-	}
-	return uint8(STA_NOINIT)
+func disk_initialize(tls *libc.TLS, fs uintptr) (r DSTATUS) {
+	// Devices are initialized by the caller before being handed to Mount,
+	// so there is nothing left to do other than report their status.
+	return disk_status(tls, fs)
 }
 
 /*-----------------------------------------------------------------------*/
 /* Read Sector(s)                                                        */
 /*-----------------------------------------------------------------------*/
-func disk_read(tls *libc.TLS, pdrv BYTE, buff uintptr, sector LBA_t, count UINT) (r DRESULT) {
-	var res DRESULT
-	var result int32
-	_, _ = res, result
-	switch int32(int32(pdrv)) {
-	case DEV_RAM:
-		result = RAM_disk_read(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	case int32(DEV_MMC):
-		result = MMC_disk_read(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	case int32(DEV_USB):
-		result = USB_disk_read(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	}
-	return RES_PARERR
+//go:nocheckptr
+func disk_read(tls *libc.TLS, fs uintptr, buff uintptr, sector LBA_t, count UINT) (r DRESULT) {
+	dev := (*FATFS)(unsafe.Pointer(fs)).dev
+	if dev == nil {
+		return RES_NOTRDY
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(buff)), int(count)*dev.SectorSize())
+	n, err := dev.ReadBlocks(buf, int64(sector))
+	if err != nil || n != len(buf) {
+		return RES_ERROR
+	}
+	return RES_OK
 }
 
 /*-----------------------------------------------------------------------*/
 /* Write Sector(s)                                                       */
 /*-----------------------------------------------------------------------*/
-func disk_write(tls *libc.TLS, pdrv BYTE, buff uintptr, sector LBA_t, count UINT) (r DRESULT) {
-	var res DRESULT
-	var result int32
-	_, _ = res, result
-	switch int32(int32(pdrv)) {
-	case DEV_RAM:
-		result = RAM_disk_write(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	case int32(DEV_MMC):
-		result = MMC_disk_write(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	case int32(DEV_USB):
-		result = USB_disk_write(tls, buff, sector, count)
-		// translate the reslut code here
-		return res
-	}
-	return RES_PARERR
+//go:nocheckptr
+func disk_write(tls *libc.TLS, fs uintptr, buff uintptr, sector LBA_t, count UINT) (r DRESULT) {
+	dev := (*FATFS)(unsafe.Pointer(fs)).dev
+	if dev == nil {
+		return RES_NOTRDY
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(buff)), int(count)*dev.SectorSize())
+	n, err := dev.WriteBlocks(buf, int64(sector))
+	if err != nil || n != len(buf) {
+		return RES_ERROR
+	}
+	return RES_OK
 }
 
 /*-----------------------------------------------------------------------*/
 /* Miscellaneous Functions                                               */
 /*-----------------------------------------------------------------------*/
-func disk_ioctl(tls *libc.TLS, pdrv BYTE, cmd BYTE, buff uintptr) (r DRESULT) {
-	var res DRESULT
-	var result int32
-	_, _ = res, result
-	switch int32(int32(pdrv)) {
-	case DEV_RAM:
-		// Process of the command for the RAM drive
-		return res
-	case int32(DEV_MMC):
-		// Process of the command for the MMC/SD card
-		return res
-	case int32(DEV_USB):
-		// Process of the command the USB drive
-		return res
-	}
-	return RES_PARERR
+//go:nocheckptr
+func disk_ioctl(tls *libc.TLS, fs uintptr, cmd BYTE, buff uintptr) (r DRESULT) {
+	dev := (*FATFS)(unsafe.Pointer(fs)).dev
+	if dev == nil {
+		return RES_NOTRDY
+	}
+	switch cmd {
+	case CTRL_SYNC:
+		if dev.Sync() != nil {
+			return RES_ERROR
+		}
+	case GET_SECTOR_COUNT:
+		*(*LBA_t)(unsafe.Pointer(buff)) = LBA_t(dev.SectorCount())
+	case GET_SECTOR_SIZE:
+		*(*WORD)(unsafe.Pointer(buff)) = WORD(dev.SectorSize())
+	case GET_BLOCK_SIZE:
+		n := 1 // Erase block size unknown.
+		if eb, ok := dev.(EraseBlocker); ok {
+			n = eb.EraseBlockSize()
+		}
+		if n < 0 || n > math.MaxUint32 {
+			n = 0 // Invalid, f_mkfs falls back to 1.
+		}
+		*(*DWORD)(unsafe.Pointer(buff)) = DWORD(n)
+	default:
+		return RES_PARERR
+	}
+	return RES_OK
+}
+
+/*-----------------------------------------------------------------------*/
+/* Memory helpers                                                        */
+/*-----------------------------------------------------------------------*/
+// The FATFS, FIL and DIR objects live on the Go heap and reach the
+// transpiled code as uintptr, which checkptr (enabled by -race) rejects
+// on every conversion back to a pointer. The transpiled functions are
+// marked //go:nocheckptr, and these stand in for the libc routines they
+// call, which cannot be.
+
+//go:nocheckptr
+func xmemcpy(tls *libc.TLS, dest, src uintptr, n uint64) uintptr {
+	if n != 0 {
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(dest)), n), unsafe.Slice((*byte)(unsafe.Pointer(src)), n))
+	}
+	return dest
+}
+
+//go:nocheckptr
+func xmemset(tls *libc.TLS, s uintptr, c int32, n uint64) uintptr {
+	if n != 0 {
+		b := unsafe.Slice((*byte)(unsafe.Pointer(s)), n)
+		for i := range b {
+			b[i] = byte(c)
+		}
+	}
+	return s
+}
+
+//go:nocheckptr
+func xmemcmp(tls *libc.TLS, s1, s2 uintptr, n uint64) int32 {
+	for ; n != 0; n-- {
+		c1, c2 := *(*byte)(unsafe.Pointer(s1)), *(*byte)(unsafe.Pointer(s2))
+		if c1 != c2 {
+			if c1 < c2 {
+				return -1
+			}
+			return 1
+		}
+		s1++
+		s2++
+	}
+	return 0
+}
+
+// bytesAt returns the n bytes at p without copying them.
+//
+//go:nocheckptr
+func bytesAt(p uintptr, n int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), n)
+}
+
+// gostring is libc.GoString for NUL terminated strings on the Go heap.
+//
+//go:nocheckptr
+func gostring(s uintptr) string {
+	if s == 0 {
+		return ""
+	}
+	n := 0
+	for *(*byte)(unsafe.Pointer(s + uintptr(n))) != 0 {
+		n++
+	}
+	return string(unsafe.Slice((*byte)(unsafe.Pointer(s)), n))
 }
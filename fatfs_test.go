@@ -1,74 +1,94 @@
 package fatfs
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"maps"
-	"os"
-	"runtime"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
-	"unsafe"
+	"time"
 
+	"github.com/soypat/fatfs/mbr"
 	"modernc.org/libc"
 )
 
 func TestCurrent(t *testing.T) {
-	runtime.LockOSThread()
-	tls := libc.NewTLS()
-	defer tls.Close()
-	libc.SetEnviron(tls, os.Environ())
-	loadVFS()
-	var tests = []func(*testing.T, *libc.TLS){
+	var tests = []func(*testing.T){
 		testWriteNew,
-		// testReadDir,
-		// testRead,
+		testReadDir,
+		testRead,
+		testTwoDevices,
+		testFile,
+		testErrors,
+		testNoSpace,
+		testDirOps,
+		testConcurrent,
+		testTimeout,
+		testSharing,
+		testClock,
+		testFileInfo,
+		testChmod,
+		testChtimes,
+		testChdir,
+		testLabel,
+		testFormat,
+		testPartition,
+		testExFAT,
+		testSectorSize,
+		testGPT,
+		testFastSeek,
+		testExpand,
+		testForward,
+		testFind,
+		testCodePage,
 	}
 	for _, test := range tests {
-		test(t, tls)
+		test(t)
 	}
 }
 
-func testWriteNew(t *testing.T, tls *libc.TLS) {
-	defer resetVFS()
-	fss := new(FATFS)
-	fr := Mount(tls, fss, "ram", 1)
-	mustBeOK(t, fr)
+func testWriteNew(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
 
 	const mode = FA_WRITE | FA_CREATE_NEW
 	var root FIL
-	fr = Open(tls, &root, "deaconblues", mode)
+	fr := fsys.open(&root, "deaconblues", mode)
 	mustBeOK(t, fr)
 }
 
-func testReadDir(t *testing.T, tls *libc.TLS) {
-	defer resetVFS()
-
-	fss := new(FATFS)
-	fr := Mount(tls, fss, "ram", 1)
-	mustBeOK(t, fr)
+func testReadDir(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
 
 	var dp DIR
-	fr = OpenDir(tls, &dp, "rootdir")
+	fr := fsys.opendir(&dp, "rootdir")
 	mustBeOK(t, fr)
 
 	var finfo FILINFO
-	fr = ReadDir(tls, &dp, &finfo)
+	fr = fsys.readdir(&dp, &finfo)
 	mustBeOK(t, fr)
 }
 
-func testRead(t *testing.T, tls *libc.TLS) {
-	defer resetVFS()
-	var fs FATFS
-	fr := Mount(tls, &fs, "ram", 1)
-	mustBeOK(t, fr)
+func testRead(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
 
 	const mode = FA_READ
 	var root FIL
-	fr = Open(tls, &root, "rootfile", mode)
+	fr := fsys.open(&root, "rootfile", mode)
 	mustBeOK(t, fr)
 
 	buf := make([]byte, 512)
-	n, fr := Read(tls, &root, buf)
+	n, fr := fsys.read(&root, buf)
 	mustBeOK(t, fr)
 	got := string(buf[:n])
 	if got != rootFileContents {
@@ -76,10 +96,10 @@ func testRead(t *testing.T, tls *libc.TLS) {
 	}
 
 	var dirfile FIL
-	fr = Open(tls, &dirfile, "rootdir/dirfile", mode)
+	fr = fsys.open(&dirfile, "rootdir/dirfile", mode)
 	mustBeOK(t, fr)
 
-	n, fr = Read(tls, &dirfile, buf)
+	n, fr = fsys.read(&dirfile, buf)
 	mustBeOK(t, fr)
 	got = string(buf[:n])
 	if got != dirFileContents {
@@ -87,6 +107,1486 @@ func testRead(t *testing.T, tls *libc.TLS) {
 	}
 }
 
+// testTwoDevices checks that writes through one mounted device never reach
+// another device mounted at the same time and that each FS keeps talking to
+// its own storage.
+func testTwoDevices(t *testing.T) {
+	devA, devB := newKeylargo(), newKeylargo()
+	fsA, err := NewFS(devA, Config{Volume: "sd"})
+	mustNotErr(t, err)
+	defer fsA.Close()
+
+	var fp FIL
+	fr := fsA.open(&fp, "sd:newfile", FA_WRITE|FA_CREATE_NEW)
+	mustBeOK(t, fr)
+	_, fr = fsA.write(&fp, []byte("device A"))
+	mustBeOK(t, fr)
+	fr = fsA.close(&fp)
+	mustBeOK(t, fr)
+	if devA.diff() == "" {
+		t.Error("expected writes to reach device A")
+	}
+	if _, err := NewFS(devB, Config{Volume: "SD:"}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("want fs.ErrExist mounting over a mounted volume ID, got %v", err)
+	}
+
+	fsB, err := NewFS(devB, Config{Volume: "usb"})
+	mustNotErr(t, err)
+	fr = fsB.open(&fp, "usb:newfile", FA_READ)
+	if fr != FR_NO_FILE {
+		t.Errorf("want FR_NO_FILE opening file created on other device, got %v", fr)
+	}
+	if fr = fsB.open(&fp, "nodrive:newfile", FA_READ); fr != FR_INVALID_DRIVE {
+		t.Errorf("want FR_INVALID_DRIVE for unknown volume ID, got %v", fr)
+	}
+	if _, err = fsA.Stat("newfile"); err != nil {
+		t.Errorf("file vanished from device A after mounting B: %v", err)
+	}
+	if diff := devB.diff(); diff != "" {
+		t.Errorf("device B modified:\n%s", diff)
+	}
+
+	// Volume IDs are released on Close.
+	mustNotErr(t, fsB.Close())
+	fsB, err = NewFS(devB, Config{Volume: "usb"})
+	mustNotErr(t, err)
+	mustNotErr(t, fsB.Close())
+}
+
+// testFile exercises the offset semantics of File against a fresh file.
+func testFile(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+
+	f, err := fsys.OpenFile("seeker", FA_READ|FA_WRITE|FA_CREATE_NEW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("WORLD"), 6); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello" {
+		t.Errorf("ReadAt got %q, want %q", buf, "hello")
+	}
+	if _, err = f.ReadAt(buf, 8); err != io.EOF {
+		t.Errorf("ReadAt past end got err %v, want io.EOF", err)
+	}
+	if _, err = f.ReadAt(buf, 100000); err != io.EOF {
+		t.Errorf("ReadAt beyond end got err %v, want io.EOF", err)
+	}
+	if fi, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 11 {
+		t.Errorf("ReadAt beyond end changed size to %d, want 11", fi.Size())
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != 11 {
+		t.Errorf("ReadAt/WriteAt moved offset to %d, want 11", off)
+	}
+	if err = f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != 5 {
+		t.Errorf("offset after truncate got %d, want 5", off)
+	}
+	if _, err = f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(got) != "hello" {
+		t.Errorf("contents after truncate got %q, want %q", got, "hello")
+	}
+	if _, err = f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected error seeking to negative offset")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 5 || info.Name() != "seeker" {
+		t.Errorf("Stat got name %q size %d, want %q size 5", info.Name(), info.Size(), "seeker")
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("second Close got %v, want fs.ErrClosed", err)
+	}
+}
+
+func testErrors(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+
+	var tests = []struct {
+		path string
+		mode byte
+		code FRESULT
+		is   error
+	}{
+		{path: "nofile", mode: FA_READ, code: FR_NO_FILE, is: fs.ErrNotExist},
+		{path: "nodir/nofile", mode: FA_READ, code: FR_NO_PATH, is: fs.ErrNotExist},
+		{path: "rootfile", mode: FA_WRITE | FA_CREATE_NEW, code: FR_EXIST, is: fs.ErrExist},
+		{path: "rootdir", mode: FA_WRITE | FA_CREATE_ALWAYS, code: FR_DENIED, is: fs.ErrPermission},
+	}
+	for _, test := range tests {
+		_, err := fsys.OpenFile(test.path, test.mode)
+		var ferr *Error
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: want *Error, got %v", test.path, err)
+			continue
+		}
+		if ferr.Code != test.code || ferr.Op != "open" || ferr.Path != test.path {
+			t.Errorf("%s: got %+v, want code %v", test.path, *ferr, test.code)
+		}
+		if !errors.Is(err, test.is) {
+			t.Errorf("%s: %v is not %v", test.path, err, test.is)
+		}
+	}
+	for fr := FRESULT(FR_DISK_ERR); fr <= FR_INVALID_PARAMETER; fr++ {
+		if s := fr.String(); !strings.HasPrefix(s, "FR_") {
+			t.Errorf("FRESULT(%d) has no name: %q", int(fr), s)
+		}
+	}
+	err := newError("write", "full", FR_NO_SPACE)
+	if !errors.Is(err, ErrNoSpace) || errors.Is(err, fs.ErrPermission) {
+		t.Errorf("FR_NO_SPACE must only match ErrNoSpace: %v", err)
+	}
+}
+
+// testNoSpace fills a small volume and checks running out of clusters is
+// told apart from running out of root directory entries.
+func testNoSpace(t *testing.T) {
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: 2048}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD, RootEntries: 16}))
+	fsys := mustMount(t, dev)
+	defer fsys.Close()
+
+	// Fill the fixed size FAT12/16 root directory.
+	mustNotErr(t, fsys.Mkdir("data"))
+	for i := 1; i < 16; i++ {
+		f, err := fsys.OpenFile(fmt.Sprintf("file%02d", i), FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+		mustNotErr(t, f.Close())
+	}
+	var ferr *Error
+	_, err := fsys.OpenFile("file16", FA_WRITE|FA_CREATE_NEW)
+	if !errors.As(err, &ferr) || ferr.Code != FR_DENIED || errors.Is(err, ErrNoSpace) {
+		t.Errorf("create in full root directory got %v, want FR_DENIED", err)
+	}
+
+	// Fill the data area.
+	f, err := fsys.OpenFile("data/fill", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	buf := make([]byte, 32*1024)
+	for err == nil {
+		_, err = f.Write(buf)
+	}
+	if !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Write on full volume got %v, want ErrNoSpace", err)
+	}
+	mustNotErr(t, f.Close())
+	if free, err := fsys.Free(); err != nil || free != 0 {
+		t.Errorf("Free on full volume got %d, %v", free, err)
+	}
+	if err := fsys.Mkdir("data/sub"); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Mkdir on full volume got %v, want ErrNoSpace", err)
+	}
+}
+
+// testDirOps creates, renames and removes objects and checks free space is restored.
+func testDirOps(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	free, err := fsys.Free()
+	if err != nil {
+		t.Fatal(err)
+	} else if free == 0 {
+		t.Fatal("no free space on keylargo")
+	}
+
+	mustNotErr(t, fsys.Mkdir("newdir"))
+	info, err := fsys.Stat("newdir")
+	mustNotErr(t, err)
+	if !info.IsDir() {
+		t.Fatal("newdir is not a directory")
+	}
+	f, err := fsys.OpenFile("newdir/file", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	_, err = f.Write([]byte(rootFileContents))
+	mustNotErr(t, err)
+	mustNotErr(t, f.Truncate(4))
+	mustNotErr(t, f.Close())
+	info, err = fsys.Stat("newdir/file")
+	mustNotErr(t, err)
+	if info.Size() != 4 {
+		t.Errorf("truncated size got %d, want 4", info.Size())
+	}
+
+	mustNotErr(t, fsys.Rename("newdir/file", "newdir/renamed"))
+	if _, err = fsys.Stat("newdir/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of renamed file got %v, want fs.ErrNotExist", err)
+	}
+	entries, err := fsys.ReadDir("newdir")
+	mustNotErr(t, err)
+	if len(entries) != 1 || entries[0].Name() != "renamed" {
+		t.Errorf("newdir entries got %v, want [renamed]", entries)
+	}
+	if err = fsys.Remove("newdir"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("remove of non-empty dir got %v, want fs.ErrPermission", err)
+	}
+	mustNotErr(t, fsys.Remove("newdir/renamed"))
+	mustNotErr(t, fsys.Remove("newdir"))
+	after, err := fsys.Free()
+	mustNotErr(t, err)
+	if after != free {
+		t.Errorf("free space got %d, want %d", after, free)
+	}
+
+	var dp DIR
+	mustBeOK(t, fsys.opendir(&dp, "rootdir"))
+	mustBeOK(t, fsys.closedir(&dp))
+	if fr := fsys.closedir(&dp); fr != FR_INVALID_OBJECT {
+		t.Errorf("second closedir got %v, want FR_INVALID_OBJECT", fr)
+	}
+
+	mustNotErr(t, fsys.Close())
+	if err = fsys.Close(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("second Close got %v, want fs.ErrClosed", err)
+	}
+}
+
+// testConcurrent reads and writes different files of a volume from several
+// goroutines at once. Run with -race to catch unsynchronized state.
+func testConcurrent(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+
+	const workers = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			f, err := fsys.OpenFile("rootdir/dirfile", FA_READ)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			for j := 0; j < 10; j++ {
+				buf := make([]byte, len(dirFileContents))
+				if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+					errs <- err
+					return
+				} else if string(buf) != dirFileContents {
+					errs <- fmt.Errorf("dirfile contents differ: %q", buf)
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("concurrent%d", i)
+			f, err := fsys.OpenFile(name, FA_WRITE|FA_CREATE_NEW)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 10 && err == nil; j++ {
+				_, err = f.Write([]byte(name))
+			}
+			if err == nil {
+				err = f.Close()
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for i := 0; i < workers; i++ {
+		name := fmt.Sprintf("concurrent%d", i)
+		info, err := fsys.Stat(name)
+		if err != nil {
+			t.Error(err)
+		} else if info.Size() != int64(10*len(name)) {
+			t.Errorf("%s size got %d, want %d", name, info.Size(), 10*len(name))
+		}
+	}
+}
+
+// testTimeout checks an operation gives up with FR_TIMEOUT while another
+// goroutine holds the volume.
+func testTimeout(t *testing.T) {
+	fsys, err := NewFS(newKeylargo(), Config{Timeout: time.Millisecond})
+	mustNotErr(t, err)
+	defer fsys.Close()
+
+	mustBeOK(t, fsys.lock())
+	_, err = fsys.Stat("rootfile")
+	fsys.unlock()
+	var ferr *Error
+	if !errors.As(err, &ferr) || ferr.Code != FR_TIMEOUT || !ferr.Timeout() {
+		t.Errorf("want FR_TIMEOUT while volume is held, got %v", err)
+	}
+	_, err = fsys.Stat("rootfile")
+	mustNotErr(t, err)
+}
+
+// testSharing checks the open object table enforces many readers or one
+// writer and keeps open objects from being removed or renamed.
+func testSharing(t *testing.T) {
+	fsys, err := NewFS(newKeylargo(), Config{MaxOpenFiles: 1})
+	mustNotErr(t, err)
+	defer fsys.Close()
+	wantCode := func(err error, code FRESULT) {
+		t.Helper()
+		var ferr *Error
+		if !errors.As(err, &ferr) || ferr.Code != code {
+			t.Errorf("want %v, got %v", code, err)
+		}
+	}
+
+	r1, err := fsys.OpenFile("rootfile", FA_READ)
+	mustNotErr(t, err)
+	r2, err := fsys.OpenFile("rootfile", FA_READ)
+	mustNotErr(t, err)
+	_, err = fsys.OpenFile("rootfile", FA_WRITE)
+	wantCode(err, FR_LOCKED)
+	wantCode(fsys.Remove("rootfile"), FR_LOCKED)
+	wantCode(fsys.Rename("rootfile", "renamed"), FR_LOCKED)
+	_, err = fsys.OpenFile("rootdir/dirfile", FA_READ)
+	wantCode(err, FR_TOO_MANY_OPEN_FILES)
+	mustNotErr(t, r1.Close())
+	mustNotErr(t, r2.Close())
+
+	w, err := fsys.OpenFile("rootfile", FA_WRITE)
+	mustNotErr(t, err)
+	_, err = fsys.OpenFile("rootfile", FA_READ)
+	wantCode(err, FR_LOCKED)
+	mustNotErr(t, w.Close())
+
+	var dp DIR
+	mustBeOK(t, fsys.opendir(&dp, fsys.path("rootdir")))
+	wantCode(fsys.Rename("rootdir", "renamed"), FR_LOCKED)
+	mustBeOK(t, fsys.closedir(&dp))
+	mustNotErr(t, fsys.Rename("rootdir", "renamed"))
+	mustNotErr(t, fsys.Remove("rootfile"))
+}
+
+// testClock checks created files and directories are stamped by the
+// configured clock in the configured location.
+func testClock(t *testing.T) {
+	zone := time.FixedZone("UTC+3", 3*60*60)
+	now := time.Date(2024, 3, 15, 10, 45, 31, 0, time.UTC)
+	fsys, err := NewFS(newKeylargo(), Config{Clock: FixedClock(now), Location: zone})
+	mustNotErr(t, err)
+	defer fsys.Close()
+
+	f, err := fsys.OpenFile("stamped", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	_, err = f.Write([]byte("tick"))
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+	mustNotErr(t, fsys.Mkdir("stampdir"))
+	want := time.Date(2024, 3, 15, 13, 45, 30, 0, zone) // 2 second resolution.
+	for _, name := range []string{"stamped", "stampdir"} {
+		info, err := fsys.Stat(name)
+		mustNotErr(t, err)
+		if got := info.ModTime(); !got.Equal(want) || got.Location() != zone {
+			t.Errorf("%s: ModTime got %v, want %v", name, got, want)
+		}
+	}
+
+	var tests = []struct {
+		t    time.Time
+		want DWORD
+	}{
+		{t: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), want: 0x00210000},
+		{t: time.Date(1980, 1, 1, 0, 0, 1, 0, time.UTC), want: 0x00210000},
+		{t: time.Date(2107, 12, 31, 23, 59, 59, 0, time.UTC), want: 0xFF9FBF7D},
+		{t: time.Date(2200, 6, 1, 12, 0, 0, 0, time.UTC), want: 0xFF9FBF7D},
+	}
+	for _, test := range tests {
+		if got := fattime(test.t); got != test.want {
+			t.Errorf("fattime(%v) got %#x, want %#x", test.t, got, test.want)
+		}
+	}
+}
+
+func testFileInfo(t *testing.T) {
+	fsys, err := NewFS(newKeylargo(), Config{Location: time.UTC})
+	mustNotErr(t, err)
+	defer fsys.Close()
+	f, err := fsys.OpenFile("A long file name.txt", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+
+	var tests = []struct {
+		name, altname string
+		attr          byte
+		mode          fs.FileMode
+		mtime         time.Time
+	}{
+		{name: "rootfile", altname: "ROOTFILE", attr: AM_ARC, mode: 0o666, mtime: time.Date(2024, 1, 23, 23, 30, 40, 0, time.UTC)},
+		{name: "rootdir", altname: "ROOTDIR", attr: AM_DIR, mode: fs.ModeDir | 0o777, mtime: time.Date(2024, 1, 23, 23, 31, 8, 0, time.UTC)},
+		{name: "A long file name.txt", altname: "ALONGF~1.TXT", attr: AM_ARC, mode: 0o666},
+	}
+	for _, test := range tests {
+		info, err := fsys.Stat(test.name)
+		mustNotErr(t, err)
+		fi, ok := info.(FileInfo)
+		if !ok {
+			t.Fatalf("Stat returned %T, want FileInfo", info)
+		}
+		if fi.Name() != test.name || fi.AltName() != test.altname {
+			t.Errorf("names got %q/%q, want %q/%q", fi.Name(), fi.AltName(), test.name, test.altname)
+		}
+		if fi.Attr() != test.attr || fi.Mode() != test.mode || fi.IsDir() != test.mode.IsDir() {
+			t.Errorf("%s: attr %#x mode %v, want %#x %v", test.name, fi.Attr(), fi.Mode(), test.attr, test.mode)
+		}
+		if !test.mtime.IsZero() && !fi.ModTime().Equal(test.mtime) {
+			t.Errorf("%s: ModTime got %v, want %v", test.name, fi.ModTime(), test.mtime)
+		}
+	}
+	if mode := (FileInfo{attr: AM_RDO | AM_DIR}).Mode(); mode != fs.ModeDir|0o555 {
+		t.Errorf("read-only directory mode got %v, want %v", mode, fs.ModeDir|0o555)
+	}
+
+	entries, err := fsys.ReadDir("rootdir")
+	mustNotErr(t, err)
+	if len(entries) != 1 {
+		t.Fatalf("rootdir entries got %d, want 1", len(entries))
+	}
+	if fi, ok := entries[0].(FileInfo); !ok || fi.Name() != "dirfile" || fi.Size() != int64(len(dirFileContents)) {
+		t.Errorf("rootdir entry got %+v", entries[0])
+	}
+}
+
+func testChmod(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+	mustNotErr(t, fsys.Chmod("rootfile", AM_RDO|AM_HID, AM_RDO|AM_HID|AM_ARC))
+	info, err := fsys.Stat("rootfile")
+	mustNotErr(t, err)
+	if fi := info.(FileInfo); fi.Attr() != AM_RDO|AM_HID || fi.Mode() != 0o444 {
+		t.Errorf("rootfile attr %#x mode %v, want %#x %v", fi.Attr(), fi.Mode(), AM_RDO|AM_HID, fs.FileMode(0o444))
+	}
+	_, err = fsys.OpenFile("rootfile", FA_WRITE)
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("open read-only file for write got %v, want %v", err, fs.ErrPermission)
+	}
+	// Bits outside the mask are left untouched.
+	mustNotErr(t, fsys.Chmod("rootfile", 0, AM_RDO))
+	info, err = fsys.Stat("rootfile")
+	mustNotErr(t, err)
+	if attr := info.(FileInfo).Attr(); attr != AM_HID {
+		t.Errorf("rootfile attr got %#x, want %#x", attr, AM_HID)
+	}
+
+	var denied = []struct {
+		name       string
+		attr, mask byte
+	}{
+		{name: "rootfile", attr: AM_DIR, mask: AM_DIR},
+		{name: "rootdir", attr: 0, mask: AM_DIR},
+		{name: "rootfile", attr: AM_VOL, mask: AM_VOL | AM_ARC},
+		{name: "/", attr: AM_RDO, mask: AM_RDO},
+	}
+	for _, test := range denied {
+		var ferr *Error
+		err := fsys.Chmod(test.name, test.attr, test.mask)
+		if !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+			t.Errorf("Chmod(%q, %#x, %#x) got %v, want FR_DENIED", test.name, test.attr, test.mask, err)
+		}
+	}
+	info, err = fsys.Stat("rootdir")
+	mustNotErr(t, err)
+	if attr := info.(FileInfo).Attr(); attr != AM_DIR {
+		t.Errorf("rootdir attr got %#x, want %#x", attr, AM_DIR)
+	}
+	if err := fsys.Chmod("nonexistent", AM_RDO, AM_RDO); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chmod nonexistent got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func testChtimes(t *testing.T) {
+	dev := newKeylargo()
+	fsys, err := NewFS(dev, Config{Location: time.UTC})
+	mustNotErr(t, err)
+	defer fsys.Close()
+	src := time.Date(2023, 5, 6, 7, 8, 9, 567e6, time.UTC)
+	stored, err := fsys.Chtimes("rootfile", FileTimes{Modified: src, Created: src, Accessed: src})
+	mustNotErr(t, err)
+	want := FileTimes{
+		Modified: time.Date(2023, 5, 6, 7, 8, 10, 0, time.UTC),
+		Created:  time.Date(2023, 5, 6, 7, 8, 9, 570e6, time.UTC),
+		Accessed: time.Date(2023, 5, 6, 0, 0, 0, 0, time.UTC),
+	}
+	if !stored.Modified.Equal(want.Modified) || !stored.Created.Equal(want.Created) || !stored.Accessed.Equal(want.Accessed) {
+		t.Errorf("Chtimes stored %+v, want %+v", stored, want)
+	}
+	info, err := fsys.Stat("rootfile")
+	mustNotErr(t, err)
+	if !info.ModTime().Equal(want.Modified) {
+		t.Errorf("ModTime got %v, want %v", info.ModTime(), want.Modified)
+	}
+	ent := dev.findEntry("ROOTFILE   ")
+	if ent == nil {
+		t.Fatal("rootfile entry not found")
+	}
+	crtime := uint32(ent[DIR_CrtTime]) | uint32(ent[DIR_CrtTime+1])<<8 | uint32(ent[DIR_CrtTime+2])<<16 | uint32(ent[DIR_CrtTime+3])<<24
+	acdate := uint16(ent[DIR_LstAccDate]) | uint16(ent[DIR_LstAccDate+1])<<8
+	if crtime != fattime(src) || ent[DIR_CrtTime10] != 157 || acdate != uint16(fattime(src)>>16) {
+		t.Errorf("entry crtime %#x/%d acdate %#x, want %#x/157 %#x", crtime, ent[DIR_CrtTime10], acdate, fattime(src), fattime(src)>>16)
+	}
+
+	// Rounding carries into the date.
+	src = time.Date(2023, 12, 31, 23, 59, 59, 999e6, time.UTC)
+	stored, err = fsys.Chtimes("rootfile", FileTimes{Modified: src, Created: src, Accessed: src})
+	mustNotErr(t, err)
+	newYear := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !stored.Modified.Equal(newYear) || !stored.Created.Equal(newYear) || !stored.Accessed.Equal(newYear) {
+		t.Errorf("Chtimes stored %+v, want all %v", stored, newYear)
+	}
+
+	// Zero times are left untouched.
+	stored, err = fsys.Chtimes("rootdir", FileTimes{Created: src})
+	mustNotErr(t, err)
+	if !stored.Modified.IsZero() || !stored.Accessed.IsZero() {
+		t.Errorf("Chtimes stored %+v for zero times", stored)
+	}
+	info, err = fsys.Stat("rootdir")
+	mustNotErr(t, err)
+	if mtime := time.Date(2024, 1, 23, 23, 31, 8, 0, time.UTC); !info.ModTime().Equal(mtime) {
+		t.Errorf("rootdir ModTime got %v, want %v", info.ModTime(), mtime)
+	}
+
+	// Times outside of FAT's range are clamped.
+	stored, err = fsys.Chtimes("rootfile", FileTimes{Modified: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)})
+	mustNotErr(t, err)
+	if !stored.Modified.Equal(minFATTime) {
+		t.Errorf("clamped Modified got %v, want %v", stored.Modified, minFATTime)
+	}
+	stored, err = fsys.Chtimes("rootfile", FileTimes{Modified: time.Date(2107, 12, 31, 23, 59, 59, 0, time.UTC)})
+	mustNotErr(t, err)
+	if !stored.Modified.Equal(maxFATTime) {
+		t.Errorf("Modified rounded past 2107 got %v, want %v", stored.Modified, maxFATTime)
+	}
+	if _, err := fsys.Chtimes("nonexistent", FileTimes{Modified: src}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chtimes nonexistent got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func testChdir(t *testing.T) {
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+	other, err := NewFS(newKeylargo(), Config{Volume: "other"})
+	mustNotErr(t, err)
+	defer other.Close()
+	mustNotErr(t, fsys.Mkdir("rootdir/A long directory name"))
+	mustNotErr(t, other.Chdir("rootdir"))
+
+	var tests = []struct {
+		dir, cwd string
+	}{
+		{dir: "", cwd: "/"},
+		{dir: "..", cwd: "/"},
+		{dir: "rootdir", cwd: "/rootdir"},
+		{dir: "A long directory name", cwd: "/rootdir/A long directory name"},
+		{dir: "../A long directory name/.", cwd: "/rootdir/A long directory name"},
+		{dir: "..", cwd: "/rootdir"},
+		{dir: "/rootdir/../rootdir", cwd: "/rootdir"},
+		{dir: "..", cwd: "/"},
+	}
+	for _, test := range tests {
+		if test.dir != "" {
+			mustNotErr(t, fsys.Chdir(test.dir))
+		}
+		cwd, err := fsys.Getcwd()
+		mustNotErr(t, err)
+		if cwd != test.cwd {
+			t.Errorf("Chdir(%q): Getcwd got %q, want %q", test.dir, cwd, test.cwd)
+		}
+	}
+	cwd, err := other.Getcwd()
+	mustNotErr(t, err)
+	if cwd != "/rootdir" {
+		t.Errorf("other volume Getcwd got %q, want %q", cwd, "/rootdir")
+	}
+
+	// Relative paths resolve from the current directory, absolute ones from the root.
+	mustNotErr(t, fsys.Chdir("rootdir/A long directory name"))
+	for _, name := range []string{"../dirfile", "/rootdir/dirfile", "./../../rootfile"} {
+		if _, err := fsys.Stat(name); err != nil {
+			t.Errorf("Stat(%q): %v", name, err)
+		}
+	}
+	f, err := fsys.OpenFile("new.txt", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	_, err = f.Write([]byte(rootFileContents))
+	mustNotErr(t, err)
+	// An open file keeps its entry when the directory it was opened from is left.
+	mustNotErr(t, fsys.Chdir("/"))
+	fi, err := f.Stat()
+	mustNotErr(t, err)
+	if fi.Name() != "new.txt" || fi.Size() != int64(len(rootFileContents)) {
+		t.Errorf("Stat after Chdir got %q of %d bytes, want %q of %d", fi.Name(), fi.Size(), "new.txt", len(rootFileContents))
+	}
+	mustNotErr(t, f.Close())
+	mustNotErr(t, fsys.Chdir("rootdir/A long directory name"))
+	_, err = fsys.Stat("/rootdir/A long directory name/new.txt")
+	mustNotErr(t, err)
+	if _, err := NewIOFS(fsys).Open("rootfile"); err != nil {
+		t.Errorf("io/fs paths should not depend on the current directory: %v", err)
+	}
+
+	mustNotErr(t, fsys.Remove("new.txt"))
+	var ferr *Error
+	err = fsys.Remove("/rootdir/A long directory name")
+	if !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+		t.Errorf("remove current directory got %v, want FR_DENIED", err)
+	}
+	if err := fsys.Chdir("/rootfile"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chdir to file got %v, want %v", err, fs.ErrNotExist)
+	}
+	mustNotErr(t, fsys.Chdir(".."))
+	mustNotErr(t, fsys.Remove("A long directory name"))
+
+	// The current drive is the FatFs global; FS methods always name their volume.
+	defer func(vol BYTE) { currVol = vol }(currVol)
+	mustNotErr(t, Chdrive("other:"))
+	if int32(currVol) != volume_number("other") {
+		t.Errorf("Chdrive(%q) set drive %d, want %d", "other:", currVol, volume_number("other"))
+	}
+	if _, err := fsys.Stat("/rootfile"); err != nil {
+		t.Errorf("Stat after Chdrive: %v", err)
+	}
+	mustNotErr(t, Chdrive("0"))
+	if currVol != fsys.fs.ldrv {
+		t.Errorf("Chdrive(%q) set drive %d, want %d", "0", currVol, fsys.fs.ldrv)
+	}
+	if err := Chdrive("nodrive"); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_DRIVE {
+		t.Errorf("Chdrive to unmounted volume got %v, want FR_INVALID_DRIVE", err)
+	}
+}
+
+func testLabel(t *testing.T) {
+	dev := newKeylargo()
+	fsys := mustMount(t, dev)
+	label, err := fsys.Label()
+	mustNotErr(t, err)
+	if label != "keylargo" {
+		t.Errorf("Label got %q, want %q", label, "keylargo")
+	}
+	vsn, err := fsys.SerialNumber()
+	mustNotErr(t, err)
+	if vsn != 0xc512f106 {
+		t.Errorf("SerialNumber got %#x, want %#x", vsn, 0xc512f106)
+	}
+	// checkBootLabel checks the boot sector and its backup at sector 6 hold label.
+	checkBootLabel := func(label string) {
+		t.Helper()
+		for _, sect := range []int64{0, 6} {
+			blk := dev.blocks[sect]
+			if got := string(blk[BS_VolLab32 : BS_VolLab32+11]); got != label {
+				t.Errorf("sector %d BS_VolLab got %q, want %q", sect, got, label)
+			}
+		}
+	}
+
+	mustNotErr(t, fsys.SetLabel("Provision 1"))
+	label, err = fsys.Label()
+	mustNotErr(t, err)
+	if label != "PROVISION 1" {
+		t.Errorf("Label got %q, want %q", label, "PROVISION 1")
+	}
+	checkBootLabel("PROVISION 1")
+	for _, bad := range []string{"a.b", "TWELVE CHARS", "a/b", "a:b"} {
+		var ferr *Error
+		if err := fsys.SetLabel(bad); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_NAME {
+			t.Errorf("SetLabel(%q) got %v, want FR_INVALID_NAME", bad, err)
+		}
+	}
+
+	// Removing the label and setting it again allocates a new entry.
+	mustNotErr(t, fsys.SetLabel(""))
+	label, err = fsys.Label()
+	mustNotErr(t, err)
+	if label != "" {
+		t.Errorf("Label got %q after removal", label)
+	}
+	checkBootLabel("NO NAME    ")
+	mustNotErr(t, fsys.SetLabel("again"))
+	entries, err := fsys.ReadDir("/")
+	mustNotErr(t, err)
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), "again") {
+			t.Error("volume label listed as a directory entry")
+		}
+	}
+	mustNotErr(t, fsys.Close())
+
+	fsys = mustMount(t, dev)
+	defer fsys.Close()
+	label, err = fsys.Label()
+	mustNotErr(t, err)
+	if label != "AGAIN" {
+		t.Errorf("Label after remount got %q, want %q", label, "AGAIN")
+	}
+	checkBootLabel("AGAIN      ")
+	vsn, err = fsys.SerialNumber()
+	mustNotErr(t, err)
+	if vsn != 0xc512f106 {
+		t.Errorf("SerialNumber changed to %#x", vsn)
+	}
+}
+
+func testFormat(t *testing.T) {
+	var tests = []struct {
+		nblocks int64
+		opts    FormatOptions
+		fstype  BYTE
+		csize   WORD
+	}{
+		{nblocks: 4096, fstype: FS_FAT12, csize: 1},
+		{nblocks: 131072, fstype: FS_FAT16, csize: 8},
+		{nblocks: 131072, opts: FormatOptions{ClusterSize: 4096, RootEntries: 128}, fstype: FS_FAT16, csize: 8},
+		{nblocks: 262144, opts: FormatOptions{Format: FM_FAT32}, fstype: FS_FAT32, csize: 2},
+		{nblocks: 262144, opts: FormatOptions{Format: FM_FAT32 | FM_SFD, NumFATs: 2, Align: 64, Label: "Device 7", SerialNumber: 0xcafe0007}, fstype: FS_FAT32, csize: 2},
+		{nblocks: 8192, opts: FormatOptions{Format: FM_SFD, NumFATs: 2, Align: 16, Label: "fat12"}, fstype: FS_FAT12, csize: 4},
+		{nblocks: 16384, opts: FormatOptions{Format: FM_EXFAT}, fstype: FS_EXFAT, csize: 8},
+		{nblocks: 16384, opts: FormatOptions{Format: FM_EXFAT | FM_SFD, Label: "EXFAT VOL", SerialNumber: 0xcafe0018}, fstype: FS_EXFAT, csize: 8},
+	}
+	for _, test := range tests {
+		dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: test.nblocks}
+		mustNotErr(t, Format(dev, test.opts))
+		fsys := mustMount(t, dev)
+		if fsys.fs.fs_type != test.fstype || fsys.fs.csize != test.csize {
+			t.Errorf("%+v: got FAT type %d cluster %d, want %d %d", test.opts, fsys.fs.fs_type, fsys.fs.csize, test.fstype, test.csize)
+		}
+		sfd := test.opts.Format&FM_SFD != 0
+		if sfd != (fsys.fs.volbase == 0) {
+			t.Errorf("%+v: volume at sector %d", test.opts, fsys.fs.volbase)
+		}
+		if align := LBA_t(max(test.opts.Align, 1)); (fsys.fs.database-fsys.fs.volbase)%align != 0 && sfd {
+			t.Errorf("%+v: data area at sector %d not aligned to %d", test.opts, fsys.fs.database, align)
+		}
+		if test.opts.NumFATs == 2 && fsys.fs.n_fats != 2 {
+			t.Errorf("%+v: got %d FATs", test.opts, fsys.fs.n_fats)
+		}
+		if test.fstype == FS_FAT32 {
+			vbr, bak := dev.blocks[int64(fsys.fs.volbase)], dev.blocks[int64(fsys.fs.volbase)+6]
+			if vbr != bak {
+				t.Errorf("%+v: backup boot sector differs", test.opts)
+			}
+		}
+		label, err := fsys.Label()
+		mustNotErr(t, err)
+		if want := strings.ToUpper(test.opts.Label); label != want {
+			t.Errorf("%+v: Label got %q, want %q", test.opts, label, want)
+		}
+		vsn, err := fsys.SerialNumber()
+		mustNotErr(t, err)
+		if test.opts.SerialNumber != 0 && vsn != test.opts.SerialNumber {
+			t.Errorf("%+v: SerialNumber got %#x", test.opts, vsn)
+		}
+		free, err := fsys.Free()
+		mustNotErr(t, err)
+		if free <= 0 || free > test.nblocks*512 {
+			t.Errorf("%+v: Free got %d", test.opts, free)
+		}
+		f, err := fsys.OpenFile("new.txt", FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+		_, err = f.Write([]byte(rootFileContents))
+		mustNotErr(t, err)
+		mustNotErr(t, f.Close())
+		mustNotErr(t, fsys.Mkdir("dir"))
+		entries, err := fsys.ReadDir("/")
+		mustNotErr(t, err)
+		if len(entries) != 2 {
+			t.Errorf("%+v: got %d root entries, want 2", test.opts, len(entries))
+		}
+		mustNotErr(t, fsys.Close())
+	}
+
+	var bad = []struct {
+		nblocks int64
+		opts    FormatOptions
+		code    FRESULT
+	}{
+		{nblocks: 4096, opts: FormatOptions{Label: "bad.label"}, code: FR_INVALID_NAME},
+		{nblocks: 100, code: FR_MKFS_ABORTED},
+		{nblocks: 4096, opts: FormatOptions{Format: FM_FAT32}, code: FR_MKFS_ABORTED},
+	}
+	for _, test := range bad {
+		dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: test.nblocks}
+		var ferr *Error
+		if err := Format(dev, test.opts); !errors.As(err, &ferr) || ferr.Code != test.code {
+			t.Errorf("Format(%d, %+v) got %v, want %v", test.nblocks, test.opts, err, test.code)
+		}
+		if len(dev.blocks) != 0 {
+			t.Errorf("Format(%d, %+v) wrote to the device on failure", test.nblocks, test.opts)
+		}
+	}
+
+	// Without Align the data area follows the erase block size of the device.
+	for _, test := range []struct {
+		n, align int
+		aligned  bool
+	}{
+		{n: 64, aligned: true},
+		{n: 0},
+		{n: 48},
+		{n: 64, align: 1},
+	} {
+		dev := eraseDevice{&mapDevice{blocks: make(map[int64][512]byte), nblocks: 8192}, test.n}
+		mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD, Align: test.align}))
+		fsys := mustMount(t, dev)
+		database := fsys.fs.database
+		mustNotErr(t, fsys.Close())
+		if aligned := database%64 == 0; aligned != test.aligned {
+			t.Errorf("erase block %d, Align %d: data area at sector %d", test.n, test.align, database)
+		}
+	}
+}
+
+func testPartition(t *testing.T) {
+	const nblocks = 262144
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: nblocks}
+	mustNotErr(t, Partition(dev, []int64{20, 100}))
+	mustNotErr(t, Format(dev, FormatOptions{Partition: 1, Label: "boot"}))
+	mustNotErr(t, Format(dev, FormatOptions{Partition: 2, Label: "data"}))
+	blk := dev.blocks[0]
+	bs, err := mbr.ToBootSector(blk[:])
+	mustNotErr(t, err)
+	var parts = []struct {
+		start, size uint32
+		ptype       mbr.PartitionType
+	}{
+		{start: N_SEC_TRACK, size: nblocks / 100 * 20, ptype: 0x04},
+		{start: N_SEC_TRACK + nblocks/100*20, size: nblocks - N_SEC_TRACK - nblocks/100*20, ptype: 0x06},
+		{},
+	}
+	for i, want := range parts {
+		pte := bs.PartitionTable(i)
+		if pte.StartSector() != want.start || pte.NumberOfSectors() != want.size || pte.PartitionType() != want.ptype {
+			t.Errorf("partition %d got start %d size %d type %#x, want %d %d %#x", i+1,
+				pte.StartSector(), pte.NumberOfSectors(), pte.PartitionType(), want.start, want.size, want.ptype)
+		}
+	}
+
+	boot, err := NewFS(dev, Config{Volume: "0", Partition: 1})
+	mustNotErr(t, err)
+	defer boot.Close()
+	data, err := NewFS(dev, Config{Volume: "1", Partition: 2})
+	mustNotErr(t, err)
+	defer data.Close()
+	for _, v := range []struct {
+		fsys  *FS
+		label string
+		base  uint32
+	}{{fsys: boot, label: "BOOT", base: parts[0].start}, {fsys: data, label: "DATA", base: parts[1].start}} {
+		label, err := v.fsys.Label()
+		mustNotErr(t, err)
+		if label != v.label || v.fsys.fs.volbase != LBA_t(v.base) {
+			t.Errorf("volume %s got label %q at sector %d, want %q at %d", v.fsys.vol, label, v.fsys.fs.volbase, v.label, v.base)
+		}
+	}
+	f, err := data.OpenFile("data.bin", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	_, err = f.Write([]byte(rootFileContents))
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+	if _, err := boot.Stat("data.bin"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file written to the data partition visible on the boot partition: %v", err)
+	}
+	_, err = data.Stat("data.bin")
+	mustNotErr(t, err)
+
+	// Without a mapping the first FAT partition is mounted.
+	auto, err := NewFS(dev, Config{Volume: "auto"})
+	mustNotErr(t, err)
+	if label, _ := auto.Label(); label != "BOOT" {
+		t.Errorf("auto detected partition label got %q, want %q", label, "BOOT")
+	}
+	mustNotErr(t, auto.Close())
+
+	var ferr *Error
+	if _, err := NewFS(dev, Config{Volume: "2", Partition: 3}); !errors.As(err, &ferr) || ferr.Code != FR_NO_FILESYSTEM {
+		t.Errorf("mount empty partition got %v, want FR_NO_FILESYSTEM", err)
+	}
+	if _, err := NewFS(dev, Config{Volume: "2", Partition: 5}); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_PARAMETER {
+		t.Errorf("mount partition 5 got %v, want FR_INVALID_PARAMETER", err)
+	}
+	if err := Format(dev, FormatOptions{Partition: 3}); !errors.As(err, &ferr) || ferr.Code != FR_MKFS_ABORTED {
+		t.Errorf("format empty partition got %v, want FR_MKFS_ABORTED", err)
+	}
+	if err := Partition(dev, []int64{10, 10, 10, 10, 10}); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_PARAMETER {
+		t.Errorf("5 partitions got %v, want FR_INVALID_PARAMETER", err)
+	}
+}
+
+func testExFAT(t *testing.T) {
+	const nblocks = 10 << 21 // 10 GiB.
+	const off = 1<<32 + 100  // Past the FAT file size limit.
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: nblocks}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_EXFAT | FM_SFD, Label: "Big Files"}))
+	fsys := mustMount(t, dev)
+	if fsys.fs.fs_type != FS_EXFAT {
+		t.Fatalf("got FAT type %d, want FS_EXFAT", fsys.fs.fs_type)
+	}
+	label, err := fsys.Label()
+	mustNotErr(t, err)
+	if label != "Big Files" {
+		t.Errorf("Label got %q, want %q", label, "Big Files")
+	}
+	free, err := fsys.Free()
+	mustNotErr(t, err)
+
+	mustNotErr(t, fsys.Mkdir("dir"))
+	mustNotErr(t, fsys.Chdir("dir"))
+	f, err := fsys.OpenFile("big.bin", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	mustNotErr(t, fsys.Chdir("/"))
+	_, err = f.Write([]byte(rootFileContents))
+	mustNotErr(t, err)
+	_, err = f.WriteAt([]byte(rootFileContents), off)
+	mustNotErr(t, err)
+	if fi, err := f.Stat(); err != nil || fi.Name() != "big.bin" || fi.Size() != off+int64(len(rootFileContents)) {
+		t.Errorf("Stat after Chdir got %v, %v", fi, err)
+	}
+	mustNotErr(t, f.Close())
+	mustNotErr(t, fsys.Rename("dir/big.bin", "big.bin"))
+	mustNotErr(t, fsys.Close())
+
+	fsys = mustMount(t, dev)
+	defer fsys.Close()
+	fi, err := fsys.Stat("big.bin")
+	mustNotErr(t, err)
+	if want := int64(off + len(rootFileContents)); fi.Size() != want {
+		t.Errorf("Stat size got %d, want %d", fi.Size(), want)
+	}
+	f, err = fsys.OpenFile("big.bin", FA_READ)
+	mustNotErr(t, err)
+	buf := make([]byte, len(rootFileContents))
+	for _, at := range []int64{0, off} {
+		_, err = f.ReadAt(buf, at)
+		mustNotErr(t, err)
+		if string(buf) != rootFileContents {
+			t.Errorf("ReadAt %d got %q, want %q", at, buf, rootFileContents)
+		}
+	}
+	mustNotErr(t, f.Close())
+	if _, err := fsys.Stat("dir/big.bin"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("renamed file still in old directory: %v", err)
+	}
+	mustNotErr(t, fsys.Remove("big.bin"))
+	mustNotErr(t, fsys.Remove("dir"))
+	if after, err := fsys.Free(); err != nil || after != free {
+		t.Errorf("Free after removal got %d, %v, want %d", after, err, free)
+	}
+}
+
+func testSectorSize(t *testing.T) {
+	data := make([]byte, 3*FF_MAX_SS+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, ss := range []int{1024, 2048, 4096} {
+		for _, fm := range []byte{FM_FAT, FM_FAT32, FM_EXFAT} {
+			dev := sectorDevice{mapDevice: &mapDevice{blocks: make(map[int64][512]byte), nblocks: 1 << 20}, ss: ss}
+			mustNotErr(t, Format(dev, FormatOptions{Format: fm | FM_SFD, Label: "BIG SECTOR"}))
+			fsys := mustMount(t, dev)
+			if int(fsys.fs.ssize) != ss {
+				t.Errorf("sector size %d fm %d: mounted with %d byte sectors", ss, fm, fsys.fs.ssize)
+			}
+			mustNotErr(t, fsys.Mkdir("dir"))
+			f, err := fsys.OpenFile("dir/data.bin", FA_WRITE|FA_CREATE_NEW)
+			mustNotErr(t, err)
+			_, err = f.Write(data[:ss/2])
+			mustNotErr(t, err)
+			_, err = f.Write(data[ss/2:])
+			mustNotErr(t, err)
+			mustNotErr(t, f.Close())
+			mustNotErr(t, fsys.Close())
+
+			fsys = mustMount(t, dev)
+			label, err := fsys.Label()
+			mustNotErr(t, err)
+			if label != "BIG SECTOR" {
+				t.Errorf("sector size %d fm %d: Label got %q", ss, fm, label)
+			}
+			f, err = fsys.OpenFile("dir/data.bin", FA_READ)
+			mustNotErr(t, err)
+			got, err := io.ReadAll(f)
+			mustNotErr(t, err)
+			if !bytes.Equal(got, data) {
+				t.Errorf("sector size %d fm %d: read back %d bytes differing from written", ss, fm, len(got))
+			}
+			buf := make([]byte, 10)
+			_, err = f.ReadAt(buf, int64(2*ss-5))
+			mustNotErr(t, err)
+			if !bytes.Equal(buf, data[2*ss-5:2*ss+5]) {
+				t.Errorf("sector size %d fm %d: ReadAt across sector boundary got %v", ss, fm, buf)
+			}
+			mustNotErr(t, f.Close())
+			free, err := fsys.Free()
+			mustNotErr(t, err)
+			if free <= 0 || free > 512<<20 {
+				t.Errorf("sector size %d fm %d: Free got %d", ss, fm, free)
+			}
+			mustNotErr(t, fsys.Close())
+		}
+	}
+	var ferr *Error
+	dev := sectorDevice{mapDevice: &mapDevice{blocks: make(map[int64][512]byte), nblocks: 1 << 20}, ss: 2 * FF_MAX_SS}
+	if err := Format(dev, FormatOptions{}); !errors.As(err, &ferr) || ferr.Code != FR_DISK_ERR {
+		t.Errorf("format with %d byte sectors got %v, want FR_DISK_ERR", dev.ss, err)
+	}
+}
+
+func testGPT(t *testing.T) {
+	const nblocks = 1<<32 + 1<<20 // Just over 2 TiB.
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: nblocks}
+	mustNotErr(t, Partition(dev, []int64{1 << 32, 1 << 19}))
+	if blk := dev.blocks[0]; blk[MBR_Table+PTE_System] != 0xEE {
+		t.Fatalf("got MBR partition type %#x, want GPT protective 0xee", blk[MBR_Table+PTE_System])
+	}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT32, Partition: 2, Label: "high"}))
+
+	fsys, err := NewFS(dev, Config{Volume: "high", Partition: 2})
+	mustNotErr(t, err)
+	if fsys.fs.volbase <= 1<<32 {
+		t.Errorf("volume at sector %d, want past the 32-bit LBA limit", fsys.fs.volbase)
+	}
+	f, err := fsys.OpenFile("high.txt", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	_, err = f.Write([]byte(rootFileContents))
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+	mustNotErr(t, fsys.Close())
+
+	// The first partition is not formatted so auto-detection finds the second.
+	fsys = mustMount(t, dev)
+	defer fsys.Close()
+	label, err := fsys.Label()
+	mustNotErr(t, err)
+	if label != "HIGH" {
+		t.Errorf("Label got %q, want %q", label, "HIGH")
+	}
+	f, err = fsys.OpenFile("high.txt", FA_READ)
+	mustNotErr(t, err)
+	got, err := io.ReadAll(f)
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+	if string(got) != rootFileContents {
+		t.Errorf("read back %q, want %q", got, rootFileContents)
+	}
+}
+
+func testFastSeek(t *testing.T) {
+	const clusterSize = 512
+	const nclusters = 8
+	dev := &readCounter{mapDevice: &mapDevice{blocks: make(map[int64][512]byte), nblocks: 65536}}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD, ClusterSize: clusterSize}))
+	fsys := mustMount(t, dev)
+	defer fsys.Close()
+
+	// Interleave the clusters of two files so each has nclusters fragments.
+	var files [2]*File
+	for i, name := range []string{"a.bin", "b.bin"} {
+		var err error
+		files[i], err = fsys.OpenFile(name, FA_READ|FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+	}
+	for c := 0; c < nclusters; c++ {
+		for i, f := range files {
+			_, err := f.Write(bytes.Repeat([]byte{byte(i<<4 | c)}, clusterSize))
+			mustNotErr(t, err)
+		}
+	}
+	mustNotErr(t, files[1].Close())
+	f := files[0]
+	defer f.Close()
+
+	var ferr *Error
+	need, err := f.CreateLinkMap(4)
+	if !errors.As(err, &ferr) || ferr.Code != FR_NOT_ENOUGH_CORE || need != 2+2*nclusters {
+		t.Fatalf("CreateLinkMap(4) got %d, %v, want %d items and FR_NOT_ENOUGH_CORE", need, err, 2+2*nclusters)
+	}
+	need, err = f.CreateLinkMap(0)
+	mustNotErr(t, err)
+	if need != 2+2*nclusters {
+		t.Errorf("CreateLinkMap(0) got %d items, want %d", need, 2+2*nclusters)
+	}
+
+	dev.lo, dev.hi = int64(fsys.fs.fatbase), int64(fsys.fs.dirbase)
+	dev.reads = 0
+	buf := make([]byte, 3)
+	for _, c := range []int{7, 2, 5, 0, 6, 1} {
+		off := int64(c*clusterSize + 100)
+		_, err = fsys.Stat("b.bin") // Move the FAT sector out of the volume window.
+		mustNotErr(t, err)
+		_, err = f.ReadAt(buf, off)
+		mustNotErr(t, err)
+		if want := bytes.Repeat([]byte{byte(c)}, 3); !bytes.Equal(buf, want) {
+			t.Errorf("ReadAt %d got %x, want %x", off, buf, want)
+		}
+	}
+	_, err = f.WriteAt([]byte{0xff}, 3*clusterSize)
+	mustNotErr(t, err)
+	if dev.reads != 0 {
+		t.Errorf("fast seek read %d FAT sectors", dev.reads)
+	}
+	_, err = f.WriteAt(buf, nclusters*clusterSize)
+	if !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+		t.Errorf("WriteAt past the link map got %v, want FR_DENIED", err)
+	}
+	_, err = f.Seek(nclusters*clusterSize+1, io.SeekStart)
+	if !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+		t.Errorf("Seek past the link map got %v, want FR_DENIED", err)
+	}
+
+	// Truncate returns to normal seek mode and the file may grow again.
+	mustNotErr(t, f.Truncate(nclusters*clusterSize+clusterSize))
+	_, err = f.ReadAt(buf[:1], 3*clusterSize)
+	mustNotErr(t, err)
+	if buf[0] != 0xff {
+		t.Errorf("ReadAt after WriteAt got %#x, want 0xff", buf[0])
+	}
+}
+
+func testExpand(t *testing.T) {
+	const clusterSize = 4096
+	const nblocks = 4096
+	for _, fm := range []byte{FM_FAT, FM_EXFAT} {
+		dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: nblocks}
+		mustNotErr(t, Format(dev, FormatOptions{Format: fm | FM_SFD, ClusterSize: clusterSize}))
+		fsys := mustMount(t, dev)
+		// Fill the volume with single cluster files and free every other one
+		// so no two free clusters are adjacent.
+		mustNotErr(t, fsys.Mkdir("fill"))
+		var names []string
+		for i := 0; ; i++ {
+			name := "fill/" + strconv.Itoa(i)
+			f, err := fsys.OpenFile(name, FA_WRITE|FA_CREATE_NEW)
+			mustNotErr(t, err)
+			_, err = f.Write(make([]byte, clusterSize))
+			mustNotErr(t, f.Close())
+			if errors.Is(err, ErrNoSpace) {
+				mustNotErr(t, fsys.Remove(name))
+				break
+			}
+			mustNotErr(t, err)
+			names = append(names, name)
+		}
+		for i := 0; i < len(names); i += 2 {
+			mustNotErr(t, fsys.Remove(names[i]))
+		}
+
+		f, err := fsys.OpenFile("log.bin", FA_READ|FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+		var ferr *Error
+		if err := f.Expand(2*clusterSize, false); !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+			t.Errorf("fm %d: Expand over fragmented free space got %v, want FR_DENIED", fm, err)
+		}
+		// Free a run of three clusters.
+		for _, name := range names[len(names)/2 : len(names)/2+3] {
+			if err := fsys.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal(err)
+			}
+		}
+		free, err := fsys.Free()
+		mustNotErr(t, err)
+		mustNotErr(t, f.Expand(3*clusterSize, false))
+		if fi, err := f.Stat(); err != nil || fi.Size() != 0 {
+			t.Errorf("fm %d: Expand without allocation changed the file: %v, %v", fm, fi, err)
+		}
+		mustNotErr(t, f.Expand(3*clusterSize, true))
+		if need, err := f.CreateLinkMap(0); err != nil || need != 4 {
+			t.Errorf("fm %d: expanded file link map got %d items, %v, want a single fragment", fm, need, err)
+		}
+		_, err = f.WriteAt([]byte(rootFileContents), 2*clusterSize)
+		mustNotErr(t, err)
+		mustNotErr(t, f.Close())
+		if err := f.Expand(clusterSize, true); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_OBJECT {
+			t.Errorf("fm %d: Expand closed file got %v, want FR_INVALID_OBJECT", fm, err)
+		}
+		mustNotErr(t, fsys.Close())
+
+		fsys = mustMount(t, dev)
+		fi, err := fsys.Stat("log.bin")
+		mustNotErr(t, err)
+		if fi.Size() != 3*clusterSize {
+			t.Errorf("fm %d: expanded file size got %d, want %d", fm, fi.Size(), 3*clusterSize)
+		}
+		if after, err := fsys.Free(); err != nil || after != free-3*clusterSize {
+			t.Errorf("fm %d: Free after expand got %d, %v, want %d", fm, after, err, free-3*clusterSize)
+		}
+		mustNotErr(t, fsys.Close())
+	}
+}
+
+func testForward(t *testing.T) {
+	data := make([]byte, 3*512+100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	fsys := mustMount(t, newKeylargo())
+	defer fsys.Close()
+	f, err := fsys.OpenFile("stream.bin", FA_READ|FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	mustNotErr(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	mustNotErr(t, err)
+
+	// The destination goes busy after taking 700 bytes.
+	var got []byte
+	budget := 700
+	n, err := f.Forward(func(p []byte) int {
+		if len(p) == 0 {
+			return budget
+		}
+		if &p[0] != &f.fp.buf[len(got)%512] {
+			t.Error("Forward data not handed from the file sector buffer")
+		}
+		p = p[:min(len(p), budget)]
+		got = append(got, p...)
+		budget -= len(p)
+		return len(p)
+	}, int64(len(data)))
+	mustNotErr(t, err)
+	if n != 700 || !bytes.Equal(got, data[:700]) {
+		t.Errorf("Forward with backpressure got %d bytes, want the first 700", n)
+	}
+
+	// WriteTo picks up at the file offset and stops at a failing writer.
+	w := &limitWriter{n: 512}
+	n, err = f.WriteTo(w)
+	if err != io.ErrShortWrite || n != 512 || !bytes.Equal(w.buf.Bytes(), data[700:700+512]) {
+		t.Errorf("WriteTo failing writer got %d, %v, want 512 and io.ErrShortWrite", n, err)
+	}
+	var buf bytes.Buffer
+	n, err = f.WriteTo(&buf)
+	mustNotErr(t, err)
+	if n != int64(len(data)-1212) || !bytes.Equal(buf.Bytes(), data[1212:]) {
+		t.Errorf("WriteTo got %d bytes, want the last %d", n, len(data)-1212)
+	}
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != int64(len(data)) {
+		t.Errorf("offset after WriteTo got %d, %v, want %d", off, err, len(data))
+	}
+
+	wo, err := fsys.OpenFile("stream.txt", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	defer wo.Close()
+	var ferr *Error
+	if _, err := wo.WriteTo(&buf); !errors.As(err, &ferr) || ferr.Code != FR_DENIED {
+		t.Errorf("WriteTo write-only file got %v, want FR_DENIED", err)
+	}
+}
+
+func testFind(t *testing.T) {
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: 65536}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD}))
+	fsys := mustMount(t, dev)
+	defer fsys.Close()
+	for _, dir := range []string{"logs", "archive", "archive/2023", "archive/2024"} {
+		mustNotErr(t, fsys.Mkdir(dir))
+	}
+	for _, name := range []string{"logs/LOG001.CSV", "logs/log002.csv", "logs/LOG003.TXT", "logs/readme.md",
+		"logs/longname-log.csv", "archive/2023/LOG100.CSV", "archive/2024/LOG200.CSV", "archive/notes.txt"} {
+		f, err := fsys.OpenFile(name, FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+		mustNotErr(t, f.Close())
+	}
+
+	for _, test := range []struct {
+		dir, pattern string
+		want         []string
+	}{
+		{dir: "logs", pattern: "LOG*.CSV", want: []string{"LOG001.CSV", "log002.csv"}},
+		{dir: "logs", pattern: "log00?.*", want: []string{"LOG001.CSV", "LOG003.TXT", "log002.csv"}},
+		{dir: "logs", pattern: "*~1.CSV", want: []string{"longname-log.csv"}}, // Short name.
+		{dir: "logs", pattern: "*", want: []string{"LOG001.CSV", "LOG003.TXT", "log002.csv", "longname-log.csv", "readme.md"}},
+		{dir: "/archive", pattern: "*.TXT", want: []string{"notes.txt"}},
+		{dir: "logs", pattern: "*.bin"},
+	} {
+		d, info, err := fsys.FindFirst(test.dir, test.pattern)
+		var got []string
+		for ; err == nil; info, err = d.FindNext() {
+			got = append(got, info.Name())
+		}
+		if err != io.EOF {
+			t.Errorf("FindFirst(%q, %q) got error %v, want io.EOF", test.dir, test.pattern, err)
+		}
+		mustNotErr(t, d.Close())
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("FindFirst(%q, %q) got %q, want %q", test.dir, test.pattern, got, test.want)
+		}
+	}
+	if _, _, err := fsys.FindFirst("nodir", "*"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("FindFirst in missing directory got %v, want fs.ErrNotExist", err)
+	}
+
+	for _, test := range []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: "logs/LOG*.CSV", want: []string{"logs/LOG001.CSV", "logs/log002.csv"}},
+		{pattern: "archive/*/LOG[12]00.CSV", want: []string{"archive/2023/LOG100.CSV", "archive/2024/LOG200.CSV"}},
+		{pattern: "*/*.txt", want: []string{"archive/notes.txt", "logs/LOG003.TXT"}},
+		{pattern: "/logs/readme.md", want: []string{"/logs/readme.md"}},
+		{pattern: "/a*", want: []string{"/archive"}},
+		{pattern: "*/nothing*"},
+	} {
+		got, err := fsys.Glob(test.pattern)
+		mustNotErr(t, err)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Glob(%q) got %q, want %q", test.pattern, got, test.want)
+		}
+	}
+	for _, bad := range []string{"logs/[", `logs\*.csv`} {
+		if _, err := fsys.Glob(bad); err != path.ErrBadPattern {
+			t.Errorf("Glob(%q) got %v, want path.ErrBadPattern", bad, err)
+		}
+	}
+
+	// Close may be repeated and releases the pattern even once the FS is gone.
+	d, _, err := fsys.FindFirst("logs", "*")
+	mustNotErr(t, err)
+	mustNotErr(t, d.Close())
+	mustNotErr(t, d.Close())
+	d, _, err = fsys.FindFirst("logs", "*")
+	mustNotErr(t, err)
+	mustNotErr(t, fsys.Close())
+	if err := d.Close(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Finder.Close after FS.Close got %v, want fs.ErrClosed", err)
+	}
+	if d.pat != 0 {
+		t.Error("Finder.Close after FS.Close kept the pattern")
+	}
+}
+
+func testCodePage(t *testing.T) {
+	// Every character of the tables converts back to the code it came from.
+	tls := libc.NewTLS()
+	defer tls.Close()
+	for _, cp := range validcp[:len(validcp)-1] {
+		var oem []WCHAR
+		switch cp {
+		case 932, 936, 949, 950:
+			tbl := map[WORD][]WCHAR{932: oem2uni932[:], 936: oem2uni936[:], 949: oem2uni949[:], 950: oem2uni950[:]}[cp]
+			for i := 0; i < len(tbl)-2; i += 2 {
+				oem = append(oem, tbl[i])
+			}
+		default:
+			for c := WCHAR(0x80); c < 0x100; c++ {
+				oem = append(oem, c)
+			}
+		}
+		for _, c := range oem {
+			uc := ff_oem2uni(tls, c, cp)
+			if got := ff_uni2oem(tls, DWORD(uc), cp); uc == 0 || got != c {
+				t.Errorf("CP%d: %#x converts to U+%04X and back to %#x", cp, c, uc, got)
+			}
+		}
+	}
+
+	// SBCS: short names are upper-cased by the table of the code page.
+	dev := &mapDevice{blocks: make(map[int64][512]byte), nblocks: 4096}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD, Label: "été", CodePage: 850}))
+	if bs := dev.blocks[0]; string(bs[BS_VolLab:BS_VolLab+11]) != "\x90T\x90        " {
+		t.Errorf("CP850 BS_VolLab got %q", bs[BS_VolLab:BS_VolLab+11])
+	}
+	fsys, err := NewFS(dev, Config{CodePage: 850})
+	mustNotErr(t, err)
+	label, err := fsys.Label()
+	mustNotErr(t, err)
+	if label != "ÉTÉ" {
+		t.Errorf("CP850 Label got %q, want %q", label, "ÉTÉ")
+	}
+	for _, name := range []string{"naïve.txt", "Ärger.txt"} {
+		f, err := fsys.OpenFile(name, FA_WRITE|FA_CREATE_NEW)
+		mustNotErr(t, err)
+		mustNotErr(t, f.Close())
+	}
+	mustNotErr(t, fsys.Close())
+	for _, sfn := range []string{"NA\xd8VE   TXT", "\x8eRGER   TXT"} {
+		if dev.findEntry(sfn) == nil {
+			t.Errorf("CP850 short name %q not found", sfn)
+		}
+	}
+	// The same bytes read in another code page.
+	fsys, err = NewFS(dev, Config{CodePage: 866})
+	mustNotErr(t, err)
+	label, err = fsys.Label()
+	mustNotErr(t, err)
+	if label != "РTР" {
+		t.Errorf("CP866 Label got %q, want %q", label, "РTР")
+	}
+	mustNotErr(t, fsys.Close())
+
+	// DBCS: double byte characters are kept whole.
+	dev = &mapDevice{blocks: make(map[int64][512]byte), nblocks: 4096}
+	mustNotErr(t, Format(dev, FormatOptions{Format: FM_FAT | FM_SFD, CodePage: 936}))
+	fsys, err = NewFS(dev, Config{CodePage: 936})
+	mustNotErr(t, err)
+	mustNotErr(t, fsys.SetLabel("中文"))
+	label, err = fsys.Label()
+	mustNotErr(t, err)
+	if label != "中文" {
+		t.Errorf("CP936 Label got %q, want %q", label, "中文")
+	}
+	f, err := fsys.OpenFile("数据.txt", FA_WRITE|FA_CREATE_NEW)
+	mustNotErr(t, err)
+	mustNotErr(t, f.Close())
+	mustNotErr(t, fsys.Close())
+	if dev.findEntry("\xca\xfd\xbe\xdd    TXT") == nil {
+		t.Error("CP936 short name not found")
+	}
+
+	for _, cp := range []int{1252, 65536, -1} {
+		var ferr *Error
+		if _, err := NewFS(dev, Config{CodePage: cp}); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_PARAMETER {
+			t.Errorf("NewFS with CodePage %d got %v, want FR_INVALID_PARAMETER", cp, err)
+		}
+		if err := Format(dev, FormatOptions{CodePage: cp}); !errors.As(err, &ferr) || ferr.Code != FR_INVALID_PARAMETER {
+			t.Errorf("Format with CodePage %d got %v, want FR_INVALID_PARAMETER", cp, err)
+		}
+	}
+}
+
+func mustMount(t *testing.T, dev BlockDevice) *FS {
+	t.Helper()
+	fsys, err := NewFS(dev, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func mustNotErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func mustBeOK(t *testing.T, fr FRESULT) {
 	t.Helper()
 	if fr != FR_OK {
@@ -94,50 +1594,122 @@ func mustBeOK(t *testing.T, fr FRESULT) {
 	}
 }
 
-func vfsDiff() string {
-	var diff string
-	for k, v := range fatInit {
-		cp := fatInitCopy[k]
-		if v != cp {
-			diff += fmt.Sprintf("block %d differs new!=old\n%s\n%s\n", k, hex.Dump(v[:]), hex.Dump(cp[:]))
-		}
+// mapDevice is a sparse in-memory BlockDevice of 512 byte sectors.
+// Sectors not present in the map read as zeros.
+type mapDevice struct {
+	blocks  map[int64][512]byte
+	nblocks int64
+}
+
+// newKeylargo returns a fresh copy of the keylargo fixture image.
+func newKeylargo() *mapDevice {
+	return &mapDevice{
+		blocks:  maps.Clone(fatInit),
+		nblocks: 15730640, // BPB_TotSec32 of keylargo.
 	}
-	return diff
 }
 
-func resetVFS() {
-	fatInit = maps.Clone(fatInitCopy)
+func (d *mapDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	if len(dst)%512 != 0 || startBlock < 0 || startBlock+int64(len(dst)/512) > d.nblocks {
+		return 0, errors.New("mapDevice: out of bounds read")
+	}
+	for i := 0; i < len(dst); i += 512 {
+		sec := d.blocks[startBlock+int64(i/512)]
+		copy(dst[i:], sec[:])
+	}
+	return len(dst), nil
 }
 
-func loadVFS() {
-	runtime.LockOSThread()
-	const vfsLim = 32000 * 512
-	RAM_disk_read = func(tls *libc.TLS, buf uintptr, sector, count UINT) (r int32) {
-		for i := UINT(0); i < count; i++ {
-			off := uintptr(i) * 512
-			if off > vfsLim {
-				return 1
-			}
-			buff := (*[512]byte)(unsafe.Pointer(buf + off))
-			sec := fatInit[int64(sector)+int64(i)]
-			copy(buff[:], sec[:])
-		}
-		return 0
+func (d *mapDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	if len(data)%512 != 0 || startBlock < 0 || startBlock+int64(len(data)/512) > d.nblocks {
+		return 0, errors.New("mapDevice: out of bounds write")
+	}
+	for i := 0; i < len(data); i += 512 {
+		d.blocks[startBlock+int64(i/512)] = [512]byte(data[i : i+512])
+	}
+	return len(data), nil
+}
+
+func (d *mapDevice) Sync() error        { return nil }
+func (d *mapDevice) SectorCount() int64 { return d.nblocks }
+func (d *mapDevice) SectorSize() int    { return 512 }
+func (d *mapDevice) Status() DSTATUS    { return 0 }
+
+// sectorDevice presents a mapDevice as a device of ss byte sectors.
+type sectorDevice struct {
+	*mapDevice
+	ss int
+}
+
+func (d sectorDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	return d.mapDevice.ReadBlocks(dst, startBlock*int64(d.ss/512))
+}
+
+func (d sectorDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	return d.mapDevice.WriteBlocks(data, startBlock*int64(d.ss/512))
+}
+
+func (d sectorDevice) SectorCount() int64 { return d.nblocks / int64(d.ss/512) }
+func (d sectorDevice) SectorSize() int    { return d.ss }
+
+// eraseDevice presents a mapDevice as flash media with erase blocks of n sectors.
+type eraseDevice struct {
+	*mapDevice
+	n int
+}
+
+func (d eraseDevice) EraseBlockSize() int { return d.n }
+
+// readCounter counts the reads of a mapDevice that touch blocks lo through hi-1.
+type readCounter struct {
+	*mapDevice
+	lo, hi int64
+	reads  int
+}
+
+func (d *readCounter) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	if startBlock < d.hi && startBlock+int64(len(dst)/512) > d.lo {
+		d.reads++
 	}
-	RAM_disk_write = func(tls *libc.TLS, buf uintptr, sector, count UINT) (r int32) {
-		for i := UINT(0); i < count; i++ {
-			off := uintptr(i) * 512
-			if off > vfsLim {
-				return 1
+	return d.mapDevice.ReadBlocks(dst, startBlock)
+}
+
+// limitWriter accepts n bytes and then writes short.
+type limitWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	p = p[:min(len(p), w.n)]
+	w.n -= len(p)
+	return w.buf.Write(p)
+}
+
+// findEntry returns the first short file name directory entry named sfn,
+// in its padded 8.3 form, or nil if there is none.
+func (d *mapDevice) findEntry(sfn string) []byte {
+	for _, blk := range d.blocks {
+		for i := 0; i < len(blk); i += SZDIRE {
+			if string(blk[i:i+11]) == sfn && blk[i+DIR_Attr] != AM_LFN {
+				return blk[i : i+SZDIRE]
 			}
-			buff := (*[512]byte)(unsafe.Pointer(buf + off))
-			fatInit[int64(sector)+int64(i)] = *buff
 		}
-		return 0
 	}
+	return nil
 }
 
-var fatInitCopy = maps.Clone(fatInit)
+// diff returns a hexdump of the sectors that differ from the keylargo fixture.
+func (d *mapDevice) diff() string {
+	var diff string
+	for k, v := range d.blocks {
+		cp := fatInit[k]
+		if v != cp {
+			diff += fmt.Sprintf("block %d differs new!=old\n%s\n%s\n", k, hex.Dump(v[:]), hex.Dump(cp[:]))
+		}
+	}
+	return diff
+}
 
 // Start of clean slate FAT32 filesystem image with name `keylargo`, 8GB in size.
 // Contains a folder structure with a rootfile with some test, a rootdir directory
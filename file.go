@@ -0,0 +1,358 @@
+package fatfs
+
+import (
+	"io"
+	"io/fs"
+	"math"
+)
+
+var (
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ io.ReaderAt        = (*File)(nil)
+	_ io.WriterAt        = (*File)(nil)
+	_ io.WriterTo        = (*File)(nil)
+	_ io.Closer          = (*File)(nil)
+	_ fs.File            = (*File)(nil)
+)
+
+// File is an open file on a mounted volume. It mimics [os.File]: reads and
+// writes advance a single file offset shared with Seek, while ReadAt and
+// WriteAt leave it untouched.
+type File struct {
+	fsys    *FS
+	fp      FIL
+	name    string
+	lfn     string // Names of the entry at open, see Stat.
+	altname string
+}
+
+// Name returns the name of the file as passed to [FS.OpenFile].
+func (f *File) Name() string { return f.name }
+
+// Read reads up to len(b) bytes from the file. At end of file it returns 0, io.EOF.
+func (f *File) Read(b []byte) (int, error) {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("read", fr)
+	}
+	defer f.fsys.unlock()
+	return f.read(b)
+}
+
+// Write writes len(b) bytes to the file. A short write returns an error
+// wrapping [ErrNoSpace].
+func (f *File) Write(b []byte) (int, error) {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("write", fr)
+	}
+	defer f.fsys.unlock()
+	return f.write(b)
+}
+
+// Seek sets the offset for the next Read or Write. Seeking past the end of a
+// file opened with FA_WRITE expands the file; otherwise the offset is clipped
+// to the file size.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("seek", fr)
+	}
+	defer f.fsys.unlock()
+	return f.seek(offset, whence)
+}
+
+// ReadAt reads len(b) bytes starting at offset off without moving the file offset.
+// It returns io.EOF when fewer than len(b) bytes are read because of end of file.
+func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 || off > f.maxSize() {
+		return 0, f.wrapErr("readat", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("readat", fr)
+	}
+	defer f.fsys.unlock()
+	if off >= int64(f.fp.obj.objsize) {
+		return 0, io.EOF // Seeking there would expand a file open for writing.
+	}
+	prev := f.fp.fptr
+	fr := f.lseek(FSIZE_t(off))
+	if fr != FR_OK {
+		return 0, f.wrapErr("readat", fr)
+	}
+	for n < len(b) && err == nil {
+		var nn int
+		nn, err = f.read(b[n:])
+		n += nn
+	}
+	if fr = f.lseek(prev); fr != FR_OK && err == nil {
+		err = f.wrapErr("readat", fr)
+	}
+	return n, err
+}
+
+// WriteAt writes len(b) bytes starting at offset off without moving the file offset.
+func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 || off > f.maxSize() {
+		return 0, f.wrapErr("writeat", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("writeat", fr)
+	}
+	defer f.fsys.unlock()
+	prev := f.fp.fptr
+	if _, err = f.seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err = f.write(b)
+	if fr := f.lseek(prev); fr != FR_OK && err == nil {
+		err = f.wrapErr("writeat", fr)
+	}
+	return n, err
+}
+
+// Truncate changes the size of the file. The file offset is clipped to the
+// new size. A file in fast seek mode returns to normal seek mode.
+func (f *File) Truncate(size int64) error {
+	if size < 0 || size > f.maxSize() {
+		return f.wrapErr("truncate", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return f.wrapErr("truncate", fr)
+	}
+	defer f.fsys.unlock()
+	f.fsys.droplinkmap(&f.fp)
+	prev := f.fp.fptr
+	if _, err := f.seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	fr := f.fsys.truncate(&f.fp)
+	if fr != FR_OK {
+		return f.wrapErr("truncate", fr)
+	}
+	fr = f.lseek(min(prev, f.fp.obj.objsize))
+	if fr != FR_OK {
+		return f.wrapErr("truncate", fr)
+	}
+	return nil
+}
+
+// Forward streams up to n bytes from the file offset to fn like f_forward,
+// handing it the file data straight from the sector buffer of the file
+// instead of copying it to a caller buffer. Before each chunk fn is called
+// with an empty slice and returns zero if the destination is busy, which ends
+// the transfer early without error. Otherwise fn returns the number of bytes
+// of p it consumed, and consuming none also ends the transfer. p is only
+// valid during the call and fn must not use the volume. Forward returns the
+// number of bytes transferred, by which the file offset advances.
+func (f *File) Forward(fn func(p []byte) int, n int64) (int64, error) {
+	if n < 0 {
+		return 0, f.wrapErr("forward", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("forward", fr)
+	}
+	defer f.fsys.unlock()
+	return f.forward(fn, n)
+}
+
+// WriteTo writes the file from its offset to the end to w, implementing
+// [io.WriterTo] with [File.Forward] so the data is not copied on the way.
+// It stops at the first failed or short write to w, returning the error.
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("writeto", fr)
+	}
+	defer f.fsys.unlock()
+	n, ferr := f.forward(func(p []byte) int {
+		if len(p) == 0 {
+			if err != nil {
+				return 0 // Writer failed, stop.
+			}
+			return 1
+		}
+		nw, werr := w.Write(p)
+		if werr == nil && nw < len(p) {
+			werr = io.ErrShortWrite
+		}
+		err = werr
+		return nw
+	}, math.MaxInt64)
+	if err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+// Expand allocates size bytes of contiguous clusters to the file like
+// f_expand, so its data can be addressed by sector without following the
+// FAT. The file must be empty and open with FA_WRITE, and its size becomes
+// size. With allocate false the volume is only checked for a free run of
+// that length, which is then preferred by the next allocation, and the file
+// is left untouched. It fails with FR_DENIED if no such run exists.
+func (f *File) Expand(size int64, allocate bool) error {
+	if size < 0 {
+		return f.wrapErr("expand", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return f.wrapErr("expand", fr)
+	}
+	defer f.fsys.unlock()
+	var opt BYTE
+	if allocate {
+		opt = 1
+	}
+	return f.wrapErr("expand", f.fsys.expand(&f.fp, FSIZE_t(size), opt))
+}
+
+// Stat returns the file's directory entry information, read through the
+// open file so it does not depend on the current directory. The size
+// reflects data written but not yet synchronized to the volume. On FAT
+// volumes the name is the one the entry had when the file was opened.
+func (f *File) Stat() (fs.FileInfo, error) {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return nil, f.wrapErr("stat", fr)
+	}
+	defer f.fsys.unlock()
+	var fno FILINFO
+	fr := f.fsys.fstat(&f.fp, &fno)
+	if fr != FR_OK {
+		return nil, f.wrapErr("stat", fr)
+	}
+	fno.fsize = f.fp.obj.objsize
+	info := newFileInfo(&fno, f.fsys.loc)
+	if f.fsys.fs.fs_type != FS_EXFAT {
+		info.name, info.altname = f.lfn, f.altname
+	}
+	return info, nil
+}
+
+// Sync flushes the cached data and directory entry of the file to the volume.
+func (f *File) Sync() error {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return f.wrapErr("sync", fr)
+	}
+	defer f.fsys.unlock()
+	return f.wrapErr("sync", f.fsys.sync(&f.fp))
+}
+
+// Close flushes and closes the file. Closing an already closed file returns an error.
+func (f *File) Close() error {
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return f.wrapErr("close", fr)
+	}
+	defer f.fsys.unlock()
+	fr := f.fsys.close(&f.fp)
+	if fr == FR_OK {
+		f.fsys.droplinkmap(&f.fp)
+	}
+	return f.wrapErr("close", fr)
+}
+
+// CreateLinkMap switches the file to fast seek mode like f_lseek with
+// CREATE_LINKMAP. The cluster chain of the file is read once into a cluster
+// link map table (CLMT) of size items, after which Seek, ReadAt and WriteAt
+// locate data without reading the FAT. The table takes two items per
+// fragment of the file plus two, and zero size fits it to the file. It
+// returns the number of items the file needs; if size is smaller the file is
+// left in normal seek mode and the error wraps FR_NOT_ENOUGH_CORE.
+//
+// A file cannot grow in fast seek mode: writing or seeking past its last
+// cluster fails with FR_DENIED. [File.Truncate] returns it to normal seek mode.
+func (f *File) CreateLinkMap(size int) (int, error) {
+	if size < 0 || size > math.MaxUint32 {
+		return 0, f.wrapErr("linkmap", FR_INVALID_PARAMETER)
+	}
+	if fr := f.fsys.lock(); fr != FR_OK {
+		return 0, f.wrapErr("linkmap", fr)
+	}
+	defer f.fsys.unlock()
+	need, fr := f.fsys.linkmap(&f.fp, size)
+	if size == 0 && fr == FR_NOT_ENOUGH_CORE {
+		need, fr = f.fsys.linkmap(&f.fp, need)
+	}
+	return need, f.wrapErr("linkmap", fr)
+}
+
+// read, write and seek implement their exported counterparts with the volume locked.
+
+func (f *File) read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, fr := f.fsys.read(&f.fp, b)
+	if fr != FR_OK {
+		return n, f.wrapErr("read", fr)
+	} else if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *File) write(b []byte) (int, error) {
+	n, fr := f.fsys.write(&f.fp, b)
+	if fr != FR_OK {
+		return n, f.wrapErr("write", fr)
+	} else if n < len(b) && f.fp.cltbl != 0 {
+		return n, f.wrapErr("write", FR_DENIED) // End of the link map.
+	} else if n < len(b) {
+		return n, f.wrapErr("write", FR_NO_SPACE)
+	}
+	return n, nil
+}
+
+func (f *File) seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(f.fp.fptr)
+	case io.SeekEnd:
+		offset += int64(f.fp.obj.objsize)
+	default:
+		return int64(f.fp.fptr), f.wrapErr("seek", FR_INVALID_PARAMETER)
+	}
+	if offset < 0 || offset > f.maxSize() {
+		return int64(f.fp.fptr), f.wrapErr("seek", FR_INVALID_PARAMETER)
+	}
+	fr := f.lseek(FSIZE_t(offset))
+	if fr != FR_OK {
+		return int64(f.fp.fptr), f.wrapErr("seek", fr)
+	}
+	if f.fp.flag&FA_WRITE != 0 && int64(f.fp.fptr) != offset && f.fp.cltbl != 0 {
+		return int64(f.fp.fptr), f.wrapErr("seek", FR_DENIED) // Fast seek clips at the file size.
+	} else if f.fp.flag&FA_WRITE != 0 && int64(f.fp.fptr) != offset {
+		return int64(f.fp.fptr), f.wrapErr("seek", FR_NO_SPACE) // Volume full while expanding.
+	}
+	return int64(f.fp.fptr), nil
+}
+
+// maxSize returns the largest file size the volume can hold, 4 GiB minus one
+// on FAT volumes.
+func (f *File) maxSize() int64 {
+	if f.fsys.fs.fs_type == FS_EXFAT {
+		return math.MaxInt64
+	}
+	return math.MaxUint32
+}
+
+// forward implements Forward in calls of at most 4 GiB - 1 bytes, the
+// range f_forward counts.
+func (f *File) forward(fn func(p []byte) int, n int64) (int64, error) {
+	var done int64
+	for done < n {
+		btf := uint32(min(n-done, math.MaxUint32))
+		nn, fr := f.fsys.forward(&f.fp, fn, btf)
+		done += int64(nn)
+		if fr != FR_OK {
+			return done, f.wrapErr("forward", fr)
+		} else if uint32(nn) < btf {
+			break // End of file or fn stopped.
+		}
+	}
+	return done, nil
+}
+
+func (f *File) lseek(ofs FSIZE_t) FRESULT {
+	return f.fsys.lseek(&f.fp, ofs)
+}
+
+func (f *File) wrapErr(op string, fr FRESULT) error {
+	return newError(op, f.name, fr)
+}
@@ -0,0 +1,67 @@
+package fatfs
+
+import (
+	"io/fs"
+	"time"
+	"unsafe"
+)
+
+var (
+	_ fs.FileInfo = FileInfo{}
+	_ fs.DirEntry = FileInfo{}
+)
+
+// FileInfo describes a file or directory from its directory entry. It
+// implements both [fs.FileInfo] and [fs.DirEntry] and is the concrete type
+// returned by Stat and ReadDir.
+type FileInfo struct {
+	name    string
+	altname string
+	size    int64
+	attr    BYTE
+	mtime   time.Time
+}
+
+func newFileInfo(fno *FILINFO, loc *time.Location) FileInfo {
+	return FileInfo{
+		name:    gostring(uintptr(unsafe.Pointer(&fno.fname[0]))),
+		altname: gostring(uintptr(unsafe.Pointer(&fno.altname[0]))),
+		size:    int64(fno.fsize),
+		attr:    fno.fattrib,
+		mtime:   fatTimeIn(fno.fdate, fno.ftime, loc),
+	}
+}
+
+// Name returns the long file name, or the short one if the entry has no long name.
+func (fi FileInfo) Name() string { return fi.name }
+
+// AltName returns the 8.3 short file name of the entry, which is empty for
+// entries that only have a short name or when it could not be represented.
+func (fi FileInfo) AltName() string { return fi.altname }
+
+// Size returns the file size in bytes.
+func (fi FileInfo) Size() int64 { return fi.size }
+
+// Attr returns the raw DOS attributes of the entry, a combination of AM_* flags.
+func (fi FileInfo) Attr() byte { return fi.attr }
+
+// Mode maps the DOS attributes to file mode bits: read-only entries lack
+// write permission and directories are executable.
+func (fi FileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(0o666)
+	if fi.attr&AM_RDO != 0 {
+		mode = 0o444
+	}
+	if fi.attr&AM_DIR != 0 {
+		mode |= fs.ModeDir | 0o111
+	}
+	return mode
+}
+
+// ModTime returns the last modification time of the entry.
+func (fi FileInfo) ModTime() time.Time { return fi.mtime }
+
+func (fi FileInfo) IsDir() bool                { return fi.attr&AM_DIR != 0 }
+func (fi FileInfo) Sys() any                   { return nil }
+func (fi FileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi FileInfo) Info() (fs.FileInfo, error) { return fi, nil }
@@ -0,0 +1,159 @@
+package fatfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"modernc.org/libc"
+)
+
+// Finder is a search of a directory for the entries matching a pattern,
+// started with [FS.FindFirst]. It must be released with Close.
+type Finder struct {
+	fsys *FS
+	dp   DIR
+	pat  uintptr // Pattern C string referenced by dp.
+	name string
+}
+
+// FindFirst opens the directory dir and returns the first entry whose long
+// or short name matches pattern like f_findfirst. In pattern '?' matches
+// any character and '*' any run of characters, compared case insensitively;
+// other characters are literal. Further matches are read with
+// [Finder.FindNext]. When nothing matches the error is io.EOF, and the
+// Finder is returned whenever the error is nil or io.EOF.
+func (fsys *FS) FindFirst(dir, pattern string) (*Finder, fs.FileInfo, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return nil, nil, newError("findfirst", dir, fr)
+	}
+	defer fsys.unlock()
+	d := &Finder{fsys: fsys, name: dir}
+	d.pat, _ = libc.CString(pattern)
+	var fno FILINFO
+	fr := fsys.findfirst(&d.dp, &fno, fsys.path(dir), d.pat)
+	if fr != FR_OK {
+		libc.Xfree(fsys.tls, d.pat)
+		return nil, nil, newError("findfirst", dir, fr)
+	}
+	info, err := d.info(&fno)
+	return d, info, err
+}
+
+// FindNext returns the next entry matching the pattern of the search like
+// f_findnext, or io.EOF once there are no more.
+func (d *Finder) FindNext() (fs.FileInfo, error) {
+	if fr := d.fsys.lock(); fr != FR_OK {
+		return nil, newError("findnext", d.name, fr)
+	}
+	defer d.fsys.unlock()
+	var fno FILINFO
+	if fr := d.fsys.findnext(&d.dp, &fno); fr != FR_OK {
+		return nil, newError("findnext", d.name, fr)
+	}
+	return d.info(&fno)
+}
+
+// Close ends the search and closes its directory. The pattern is released
+// even if closing the directory fails, i.e: once the FS is closed, and
+// closing a Finder again does nothing.
+func (d *Finder) Close() error {
+	fr := d.fsys.lock()
+	if fr == FR_TIMEOUT {
+		return newError("close", d.name, fr) // The search may still be in use.
+	}
+	if fr == FR_OK {
+		defer d.fsys.unlock()
+		if d.pat == 0 {
+			return nil // Already closed.
+		}
+		fr = d.fsys.closedir(&d.dp)
+	}
+	libc.Xfree(d.fsys.tls, d.pat)
+	d.pat = 0
+	return newError("close", d.name, fr)
+}
+
+func (d *Finder) info(fno *FILINFO) (fs.FileInfo, error) {
+	if fno.fname[0] == 0 {
+		return nil, io.EOF // End of directory.
+	}
+	return newFileInfo(fno, d.fsys.loc), nil
+}
+
+// Glob returns the names of all files matching pattern, or nil if there is
+// no matching file, like [fs.Glob]. The pattern syntax is that of
+// [path.Match] with '/' separating the directory levels, and the only
+// possible error is [path.ErrBadPattern]. Unlike path.Match, names are
+// compared case insensitively as FAT does; levels using only '?' and '*'
+// are matched by [FS.FindFirst] and also match short names. FatFs takes '\'
+// as a path separator, so rather than an escape it makes the pattern bad.
+func (fsys *FS) Glob(pattern string) (matches []string, err error) {
+	if strings.ContainsRune(pattern, '\\') {
+		return nil, path.ErrBadPattern
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return fsys.glob(pattern, 0)
+}
+
+func (fsys *FS) glob(pattern string, depth int) (matches []string, err error) {
+	if !hasMeta(pattern) {
+		if _, err := fsys.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	dir, file := path.Split(pattern)
+	if dir == "" {
+		dir = "."
+	} else if dir != "/" {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	if !hasMeta(dir) {
+		return fsys.globDir(dir, file, nil), nil
+	}
+	if dir == pattern || depth > 1000 {
+		return nil, path.ErrBadPattern // Guard against unbounded recursion.
+	}
+	dirs, err := fsys.glob(dir, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		matches = fsys.globDir(d, file, matches)
+	}
+	return matches, nil
+}
+
+// globDir appends the entries of dir matching pattern to matches, ignoring
+// errors reading dir as [fs.Glob] does.
+func (fsys *FS) globDir(dir, pattern string, matches []string) []string {
+	find, match := pattern, ""
+	if strings.Contains(pattern, "[") {
+		// FatFs only knows '?' and '*', list everything and match here.
+		find, match = "*", strings.ToUpper(pattern)
+	}
+	d, info, err := fsys.FindFirst(dir, find)
+	if d == nil {
+		return matches
+	}
+	defer d.Close()
+	var names []string
+	for ; err == nil; info, err = d.FindNext() {
+		if ok, _ := path.Match(match, strings.ToUpper(info.Name())); match == "" || ok {
+			names = append(names, path.Join(dir, info.Name()))
+		}
+	}
+	slices.Sort(names)
+	return append(matches, names...)
+}
+
+// hasMeta reports whether path contains any of the magic characters
+// recognized by path.Match, short of '\' which Glob rejects.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
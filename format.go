@@ -0,0 +1,133 @@
+package fatfs
+
+import (
+	"math"
+	"runtime"
+	"unsafe"
+
+	"modernc.org/libc"
+)
+
+// FormatOptions holds the options of [Format], mirroring the MKFS_PARM
+// argument of f_mkfs. The zero value formats the whole device with the FAT
+// type and cluster size that best suit its size.
+type FormatOptions struct {
+	// Format is the combination of FM_FAT, FM_FAT32, FM_EXFAT and FM_SFD
+	// flags selecting the FAT types the volume may be created as. Zero
+	// selects FM_ANY. Unless FM_SFD is set the device is partitioned with an MBR
+	// holding the volume as its single partition.
+	Format byte
+	// NumFATs is the number of FAT copies, 1 or 2. Zero selects 1.
+	NumFATs int
+	// Align is the erase block size of flash media in sectors, a power of
+	// two. The data area is aligned to it. Zero selects the size reported by
+	// a dev implementing [EraseBlocker], or else 1, so callers formatting
+	// flash media through other devices must set it themselves.
+	Align int
+	// RootEntries is the number of root directory entries of FAT12/16
+	// volumes up to 32768, a multiple of the entries in a sector (16 with
+	// 512 byte sectors). Zero selects 512.
+	RootEntries int
+	// ClusterSize is the cluster size in bytes, a power of two. Zero picks
+	// it from the volume size.
+	ClusterSize int
+	// Label is the volume label, following the rules of [FS.SetLabel] for
+	// the chosen format: upper cased OEM bytes on FAT, case preserving
+	// UTF-16 on exFAT. Zero value creates the volume without a label.
+	Label string
+	// SerialNumber is the volume serial number. Zero generates one from the
+	// current time and the volume size.
+	SerialNumber uint32
+	// Partition is the existing MBR or GPT partition, 1 through 4, to create the
+	// volume in, see [Partition]. FM_SFD is then ignored and the rest of the
+	// device is left untouched. Zero formats the whole device.
+	Partition int
+	// CodePage is the OEM code page the label of FAT volumes is stored in,
+	// see [Config.CodePage]. Zero selects [DefaultCodePage].
+	CodePage int
+}
+
+// Format creates a FAT12, FAT16, FAT32 or exFAT volume on dev like f_mkfs,
+// erasing its contents. dev must not be mounted while it is formatted. The
+// volume can then be mounted with [NewFS]. With FM_ANY exFAT is only picked
+// for volumes of 64M sectors or more, as f_mkfs does.
+func Format(dev BlockDevice, opts FormatOptions) error {
+	if dev == nil {
+		return newError("mkfs", "", FR_INVALID_PARAMETER)
+	}
+	fmt := opts.Format
+	if fmt&FM_ANY == 0 {
+		fmt |= FM_ANY
+	}
+	var opt MKFS_PARM
+	opt.fmt = fmt
+	opt.n_fat = BYTE(opts.NumFATs)
+	opt.align = UINT(opts.Align)
+	opt.n_root = UINT(opts.RootEntries)
+	opt.au_size = DWORD(opts.ClusterSize)
+	opt.vsn = opts.SerialNumber
+	if opts.Partition < 0 || opts.Partition > 4 || opts.CodePage < 0 || opts.CodePage > math.MaxUint16 {
+		return newError("mkfs", "", FR_INVALID_PARAMETER)
+	}
+	fs := &FATFS{dev: dev, part: BYTE(opts.Partition)}
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fs)
+		pins.Pin(&opt)
+		defer pins.Unpin()
+	}
+	tls := libc.NewTLS()
+	defer tls.Close()
+	if fr := f_setcp(tls, uintptr(unsafe.Pointer(fs)), codePage(opts.CodePage)); fr != FR_OK {
+		return newError("mkfs", "", fr)
+	}
+	if opts.Label != "" {
+		label, _ := libc.CString(opts.Label)
+		defer libc.Xfree(tls, label)
+		opt.label = label
+	}
+	const worklen = 64 * FF_MAX_SS
+	work := libc.Xmalloc(tls, worklen)
+	if work == 0 {
+		return newError("mkfs", "", FR_NOT_ENOUGH_CORE)
+	}
+	defer libc.Xfree(tls, work)
+	fr := f_mkfs(tls, uintptr(unsafe.Pointer(fs)), uintptr(unsafe.Pointer(&opt)), work, worklen)
+	return newError("mkfs", "", fr)
+}
+
+// Partition creates a partition table on dev like f_fdisk, with a partition
+// for each of sizes in order. Sizes are given in sectors, or as a percentage
+// of the device for values of 100 and below. Partitions are laid out one
+// after another, up to 4, and the last is clipped to the end of the device.
+// Devices of FF_MIN_GPT sectors or more get a GPT behind a protective MBR
+// instead, so partitions may lie beyond the 32-bit LBA limit. The
+// partitions are then formatted with [Format] by their number.
+func Partition(dev BlockDevice, sizes []int64) error {
+	if dev == nil || len(sizes) > 4 {
+		return newError("fdisk", "", FR_INVALID_PARAMETER)
+	}
+	var ptbl [5]LBA_t // Zero terminated for GPT.
+	for i, size := range sizes {
+		if size <= 0 {
+			return newError("fdisk", "", FR_INVALID_PARAMETER)
+		}
+		ptbl[i] = LBA_t(size)
+	}
+	fs := &FATFS{dev: dev}
+	if enablePinning {
+		var pins runtime.Pinner
+		pins.Pin(fs)
+		pins.Pin(&ptbl)
+		defer pins.Unpin()
+	}
+	tls := libc.NewTLS()
+	defer tls.Close()
+	work := libc.Xmalloc(tls, FF_MAX_SS)
+	if work == 0 {
+		return newError("fdisk", "", FR_NOT_ENOUGH_CORE)
+	}
+	defer libc.Xfree(tls, work)
+	fr := f_fdisk(tls, uintptr(unsafe.Pointer(fs)), uintptr(unsafe.Pointer(&ptbl)), work)
+	return newError("fdisk", "", fr)
+}
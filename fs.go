@@ -0,0 +1,449 @@
+// Package fatfs is the FatFs FAT and exFAT filesystem module, transpiled
+// from C with ccgo, behind a Go API modeled on the os and io/fs packages.
+//
+// Sector numbers (LBA_t) are always 64 bits wide, as with FF_LBA64 in FatFs,
+// so volumes and GPT partitions may lie beyond 2 TiB. This is not a build
+// option: the transpiled code hard-codes the field offsets of its objects.
+// The cost is 4 more bytes for each sector field, at most 24 bytes per FATFS
+// and 8 per FIL and DIR, plus 64-bit sector arithmetic.
+package fatfs
+
+import (
+	"io/fs"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"modernc.org/libc"
+)
+
+// DefaultTimeout is the time an FS operation waits for access to a volume
+// in use by another goroutine when [Config] does not set one, like FF_FS_TIMEOUT.
+const DefaultTimeout = time.Second
+
+// DefaultCodePage is the OEM code page of volumes whose [Config] does not
+// set one, Japanese Shift_JIS.
+const DefaultCodePage = 932
+
+// Config holds the options of a volume mounted with [NewFS].
+type Config struct {
+	// Volume is the ID the volume is registered with, i.e: "sd", "usb" or
+	// "0". Paths may select it with a "sd:" style prefix. Volume IDs are
+	// case insensitive and must be unique among mounted volumes. Zero
+	// value selects "0".
+	Volume string
+	// Timeout is the time an operation waits for access to the volume
+	// before failing with FR_TIMEOUT. Zero selects [DefaultTimeout] and a
+	// negative value waits forever.
+	Timeout time.Duration
+	// MaxOpenFiles is the number of distinct files and directories that may
+	// be open on the volume at once, like FF_FS_LOCK. Zero selects FF_FS_LOCK.
+	MaxOpenFiles int
+	// Clock returns the time files and directories are stamped with when
+	// created or modified. Nil selects time.Now; see [FixedClock] for
+	// reproducible images.
+	Clock func() time.Time
+	// Location is the time zone FAT timestamps, which carry none, are
+	// written and read in. Nil selects time.Local.
+	Location *time.Location
+	// Partition is the MBR partition, 1 through 4, the volume is in, like
+	// the VolToPart table of FF_MULTI_PARTITION. Zero mounts the device
+	// itself if it holds a volume without a partition table, or else its
+	// first FAT partition. Volumes in different partitions of a device may
+	// be mounted at once, in which case the device must be safe for
+	// concurrent use as each volume is accessed under its own lock.
+	Partition int
+	// CodePage is the OEM code page short file names and the volume label
+	// of FAT volumes are stored in, like f_setcp: 437, 850, 852, 866, 932,
+	// 936, 949 or 950. Names beyond ASCII only read the same on systems
+	// using the same code page. Zero selects [DefaultCodePage].
+	CodePage int
+}
+
+// codePage returns the code page selected by a CodePage option.
+func codePage(cp int) WORD {
+	if cp == 0 {
+		return DefaultCodePage
+	}
+	return WORD(cp)
+}
+
+// FixedClock returns a [Config.Clock] that always reports t.
+func FixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+// FS is a mounted FAT volume. It owns the C runtime state and the filesystem
+// object FatFs operates on, so callers only deal with Go values. An FS must be
+// released with Close once it is no longer needed.
+//
+// Files are shared following the FatFs rules: a file may be open by many
+// readers or a single writer, and open files and directories can be neither
+// removed nor renamed. Conflicting operations fail with FR_LOCKED.
+//
+// An FS and the files opened on it are safe for concurrent use by multiple
+// goroutines: operations on a volume are serialized by a per-volume lock in
+// the manner of FatFs's FF_FS_REENTRANT.
+//
+// Paths taken by FS methods are FatFs paths on the mounted volume using slash
+// or backslash as separator. Paths starting with a separator, i.e: "/dir/file",
+// are absolute; others are relative to the current directory of the volume,
+// which starts at the root and is changed with [FS.Chdir]. "." and ".." name the
+// directory itself and its parent.
+type FS struct {
+	mu      chan struct{} // Volume lock, held while sending to it.
+	timeout time.Duration
+	tls     *libc.TLS
+	fs      FATFS
+	vol     string // Logical drive prefix of the volume, i.e: "0:".
+	loc     *time.Location
+}
+
+// NewFS mounts the FAT volume on dev under the volume ID of cfg and returns
+// a handle to it. Several volumes may be mounted at once, each on its own device.
+func NewFS(dev BlockDevice, cfg Config) (*FS, error) {
+	id := strings.TrimSuffix(cfg.Volume, ":")
+	if id == "" {
+		id = "0"
+	}
+	if strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || strings.ContainsRune(`:/\`, r) }) {
+		return nil, &Error{Op: "mount", Path: cfg.Volume, Code: FR_INVALID_DRIVE}
+	}
+	if cfg.Partition < 0 || cfg.Partition > 4 || cfg.CodePage < 0 || cfg.CodePage > math.MaxUint16 {
+		return nil, &Error{Op: "mount", Path: id + ":", Code: FR_INVALID_PARAMETER}
+	}
+	fsys := &FS{
+		mu:      make(chan struct{}, 1),
+		timeout: cfg.Timeout,
+		vol:     id + ":",
+		loc:     cfg.Location,
+	}
+	if fsys.timeout == 0 {
+		fsys.timeout = DefaultTimeout
+	}
+	if fsys.loc == nil {
+		fsys.loc = time.Local
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	fsys.fs.clock = func() time.Time { return clock().In(fsys.loc) }
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+	vol, fr := addVolume(id)
+	if fr != FR_OK {
+		return nil, newError("mount", fsys.vol, fr)
+	}
+	nfiles := cfg.MaxOpenFiles
+	if nfiles <= 0 {
+		nfiles = FF_FS_LOCK
+	}
+	fsys.fs.files = make([]FILESEM, nfiles)
+	fsys.fs.part = BYTE(cfg.Partition)
+	fsys.tls = libc.NewTLS()
+	fr = fsys.setcp(codePage(cfg.CodePage))
+	if fr == FR_OK {
+		fr = fsys.mount(dev, fsys.vol, 1)
+	}
+	if fr != FR_OK {
+		fsys.unmount(fsys.vol)
+		removeVolume(vol)
+		fsys.tls.Close()
+		return nil, newError("mount", fsys.vol, fr)
+	}
+	return fsys, nil
+}
+
+// Chdrive sets the current drive to the mounted volume with the given ID,
+// like f_chdrive. It exists for FatFs compatibility: the current drive is
+// process-wide state that only selects the volume of FatFs paths without a
+// "vol:" prefix, and FS methods always name their own volume, so it does
+// not change what they resolve. Current directories are kept per volume.
+func Chdrive(volume string) error {
+	id := strings.TrimSuffix(volume, ":")
+	if id == "" {
+		id = "0"
+	}
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+	if driveTLS == nil {
+		driveTLS = libc.NewTLS()
+	}
+	_path, _ := libc.CString(id + ":")
+	defer libc.Xfree(driveTLS, _path)
+	return newError("chdrive", volume, f_chdrive(driveTLS, _path))
+}
+
+// Close unmounts the volume and frees the resources held by fsys.
+// Files and directories still open on the volume become invalid.
+func (fsys *FS) Close() error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("unmount", fsys.vol, fr)
+	}
+	defer fsys.unlock()
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+	fr := fsys.unmount(fsys.vol)
+	removeVolume(int32(fsys.fs.ldrv))
+	fsys.tls.Close()
+	fsys.tls = nil
+	return newError("unmount", fsys.vol, fr)
+}
+
+// OpenFile opens the named file with the FA_* access mode and open method flags.
+func (fsys *FS) OpenFile(name string, mode byte) (*File, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	defer fsys.unlock()
+	f, fr := fsys.openFile(name, fsys.path(name), mode)
+	if fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	return f, nil
+}
+
+// openFile opens the file at path on the locked volume as the File called name.
+func (fsys *FS) openFile(name, path string, mode byte) (*File, FRESULT) {
+	f := &File{fsys: fsys, name: name}
+	fr := fsys.open(&f.fp, path, mode)
+	if fr == FR_OK && fsys.fs.fs_type != FS_EXFAT {
+		// FAT entries keep the long name apart, out of reach of File.Stat.
+		var fno FILINFO
+		if fr = fsys.stat(path, &fno); fr == FR_OK {
+			info := newFileInfo(&fno, fsys.loc)
+			f.lfn, f.altname = info.name, info.altname
+		} else {
+			fsys.close(&f.fp)
+		}
+	}
+	if fr != FR_OK {
+		return nil, fr
+	}
+	return f, FR_OK
+}
+
+// Stat returns a [FileInfo] describing the named file or directory.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return nil, newError("stat", name, fr)
+	}
+	defer fsys.unlock()
+	var fno FILINFO
+	fr := fsys.stat(fsys.path(name), &fno)
+	if fr != FR_OK {
+		return nil, newError("stat", name, fr)
+	}
+	return newFileInfo(&fno, fsys.loc), nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by filename.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir := &iofsDir{fsys: fsys, info: FileInfo{name: name, attr: AM_DIR}}
+	fr := fsys.lock()
+	if fr == FR_OK {
+		fr = fsys.opendir(&dir.dp, fsys.path(name))
+		fsys.unlock()
+	}
+	if fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, err
+}
+
+// Mkdir creates a new directory.
+func (fsys *FS) Mkdir(name string) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("mkdir", name, fr)
+	}
+	defer fsys.unlock()
+	return newError("mkdir", name, fsys.mkdir(fsys.path(name)))
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *FS) Remove(name string) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("remove", name, fr)
+	}
+	defer fsys.unlock()
+	return newError("remove", name, fsys.unlink(fsys.path(name)))
+}
+
+// Rename renames or moves oldname to newname within the volume.
+func (fsys *FS) Rename(oldname, newname string) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("rename", oldname, fr)
+	}
+	defer fsys.unlock()
+	return newError("rename", oldname, fsys.rename(fsys.path(oldname), fsys.path(newname)))
+}
+
+// Chdir changes the current directory of the volume, like f_chdir. The current
+// directory is kept per volume, so volumes mounted at once do not affect each
+// other. exFAT directories have no dot entries, so there ".." names the
+// directory itself rather than its parent.
+func (fsys *FS) Chdir(name string) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("chdir", name, fr)
+	}
+	defer fsys.unlock()
+	return newError("chdir", name, fsys.chdir(fsys.path(name)))
+}
+
+// Getcwd returns the absolute path of the current directory of the volume,
+// i.e: "/dir/sub", like f_getcwd. exFAT directories hold no ".." entry to
+// follow back to the root, so on exFAT volumes it always returns "/".
+func (fsys *FS) Getcwd() (string, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return "", newError("getcwd", fsys.vol, fr)
+	}
+	defer fsys.unlock()
+	cwd, fr := fsys.getcwd(fsys.vol)
+	if fr != FR_OK {
+		return "", newError("getcwd", fsys.vol, fr)
+	}
+	return strings.TrimPrefix(cwd, fsys.vol), nil
+}
+
+// Chmod sets the AM_RDO, AM_HID, AM_SYS and AM_ARC attributes selected by mask
+// to their value in attr, leaving the rest untouched. Attributes of the root
+// directory and the AM_DIR and AM_VOL bits cannot be changed; attempts to do
+// so fail with FR_DENIED.
+func (fsys *FS) Chmod(name string, attr, mask byte) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("chmod", name, fr)
+	}
+	defer fsys.unlock()
+	return newError("chmod", name, fsys.chmod(fsys.path(name), attr, mask))
+}
+
+// FileTimes holds the timestamps of a directory entry. FAT keeps the
+// modification time with 2 second resolution, the creation time with 10
+// millisecond resolution and the last access as a date only.
+type FileTimes struct {
+	Modified time.Time
+	Created  time.Time
+	Accessed time.Time
+}
+
+// Chtimes sets the timestamps of the named file or directory to those in
+// times, like f_utime. Zero times leave the matching timestamp unchanged.
+// Times are rounded to the nearest value FAT can keep, carrying into the date
+// when needed, and then clamped to the years 1980 through 2107; Chtimes returns
+// the times as stored so callers can tell how much precision was lost.
+func (fsys *FS) Chtimes(name string, times FileTimes) (FileTimes, error) {
+	var stored FileTimes
+	var mtime, crtime DWORD
+	var crtime10 BYTE
+	var acdate WORD
+	if !times.Modified.IsZero() {
+		mtime = fattime(fatRound(times.Modified.In(fsys.loc), 2*time.Second))
+		stored.Modified = fatTimeIn(WORD(mtime>>16), WORD(mtime), fsys.loc)
+	}
+	if !times.Created.IsZero() {
+		t := fatRound(times.Created.In(fsys.loc), 10*time.Millisecond)
+		crtime, crtime10 = fattime(t), fattime10(t)
+		stored.Created = fatTimeIn(WORD(crtime>>16), WORD(crtime), fsys.loc).Add(time.Duration(crtime10) * 10 * time.Millisecond)
+	}
+	if !times.Accessed.IsZero() {
+		acdate = WORD(fattime(fatRound(times.Accessed.In(fsys.loc), 24*time.Hour)) >> 16)
+		stored.Accessed = fatTimeIn(acdate, 0, fsys.loc)
+	}
+	if fr := fsys.lock(); fr != FR_OK {
+		return FileTimes{}, newError("chtimes", name, fr)
+	}
+	defer fsys.unlock()
+	fr := fsys.utime(fsys.path(name), mtime, crtime, crtime10, acdate)
+	if fr != FR_OK {
+		return FileTimes{}, newError("chtimes", name, fr)
+	}
+	return stored, nil
+}
+
+// Free returns the free space on the volume in bytes.
+func (fsys *FS) Free() (int64, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return 0, newError("getfree", fsys.vol, fr)
+	}
+	defer fsys.unlock()
+	nclst, csize, fr := fsys.getfree(fsys.vol)
+	if fr != FR_OK {
+		return 0, newError("getfree", fsys.vol, fr)
+	}
+	return int64(nclst) * int64(csize), nil
+}
+
+// Label returns the volume label, read from the volume label entry of the root
+// directory like f_getlabel. It returns an empty string if the volume has none.
+func (fsys *FS) Label() (string, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return "", newError("getlabel", fsys.vol, fr)
+	}
+	defer fsys.unlock()
+	label, _, fr := fsys.getlabel(fsys.vol)
+	return label, newError("getlabel", fsys.vol, fr)
+}
+
+// SetLabel sets the volume label, like f_setlabel. On FAT volumes the label
+// is converted to upper case and may be up to 11 bytes long in the OEM code
+// page; characters not allowed in short file names and "." are rejected with
+// FR_INVALID_NAME. On exFAT volumes the label keeps its case and may be up to
+// 11 UTF-16 characters; only / \ : * ? " < > | and DEL are rejected.
+// An empty label removes it. The volume label entry of the root directory is
+// updated, along with the copies in the boot sector and its backup on FAT.
+func (fsys *FS) SetLabel(label string) error {
+	if fr := fsys.lock(); fr != FR_OK {
+		return newError("setlabel", label, fr)
+	}
+	defer fsys.unlock()
+	return newError("setlabel", label, fsys.setlabel(fsys.vol+label))
+}
+
+// SerialNumber returns the volume serial number, BS_VolID of the boot sector.
+func (fsys *FS) SerialNumber() (uint32, error) {
+	if fr := fsys.lock(); fr != FR_OK {
+		return 0, newError("getlabel", fsys.vol, fr)
+	}
+	defer fsys.unlock()
+	_, vsn, fr := fsys.getlabel(fsys.vol)
+	return vsn, newError("getlabel", fsys.vol, fr)
+}
+
+// lock acquires exclusive access to the volume, waiting at most the configured
+// timeout for other goroutines to release it. It fails with FR_INVALID_OBJECT
+// once fsys has been closed.
+func (fsys *FS) lock() FRESULT {
+	select {
+	case fsys.mu <- struct{}{}:
+	default:
+		if fsys.timeout < 0 {
+			fsys.mu <- struct{}{}
+			break
+		}
+		timer := time.NewTimer(fsys.timeout)
+		defer timer.Stop()
+		select {
+		case fsys.mu <- struct{}{}:
+		case <-timer.C:
+			return FR_TIMEOUT
+		}
+	}
+	if fsys.tls == nil {
+		<-fsys.mu
+		return FR_INVALID_OBJECT
+	}
+	return FR_OK
+}
+
+// unlock releases the volume acquired with lock.
+func (fsys *FS) unlock() { <-fsys.mu }
+
+// path converts a path on the volume of fsys to a FatFs path.
+func (fsys *FS) path(name string) string {
+	return fsys.vol + name
+}
@@ -0,0 +1,181 @@
+package fatfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+var (
+	_ fs.FS         = (*IOFS)(nil)
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+)
+
+// IOFS exposes a mounted FATFS volume as a read-only [fs.FS] so it can be
+// used with the standard library's io/fs consumers such as [fs.WalkDir],
+// http.FS or testing/fstest.
+type IOFS struct {
+	fs *FS
+}
+
+// NewIOFS returns an [fs.FS] rooted at the root directory of fsys.
+func NewIOFS(fsys *FS) *IOFS {
+	return &IOFS{fs: fsys}
+}
+
+// Open opens the named file or directory for reading.
+func (fsys *IOFS) Open(name string) (fs.File, error) {
+	if !validIOFSPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if fr := fsys.fs.lock(); fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	defer fsys.fs.unlock()
+	var fno FILINFO
+	info, fr := fsys.stat(name, &fno)
+	if fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	if info.IsDir() {
+		dir := &iofsDir{fsys: fsys.fs, info: info}
+		fr = fsys.fs.opendir(&dir.dp, fsys.fs.path(fsys.path(name)))
+		if fr != FR_OK {
+			return nil, newError("open", name, fr)
+		}
+		return dir, nil
+	}
+	file, fr := fsys.fs.openFile(name, fsys.fs.path(fsys.path(name)), FA_READ)
+	if fr != FR_OK {
+		return nil, newError("open", name, fr)
+	}
+	return file, nil
+}
+
+// Stat returns a [fs.FileInfo] describing the named file or directory.
+func (fsys *IOFS) Stat(name string) (fs.FileInfo, error) {
+	if !validIOFSPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if fr := fsys.fs.lock(); fr != FR_OK {
+		return nil, newError("stat", name, fr)
+	}
+	defer fsys.fs.unlock()
+	var fno FILINFO
+	info, fr := fsys.stat(name, &fno)
+	if fr != FR_OK {
+		return nil, newError("stat", name, fr)
+	}
+	return info, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by filename.
+func (fsys *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir, ok := f.(*iofsDir)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := dir.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, err
+}
+
+// ReadFile reads the named file and returns its contents.
+func (fsys *IOFS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file, ok := f.(*File)
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return io.ReadAll(file)
+}
+
+// path converts an io/fs path to an absolute path on the volume of fsys.
+func (fsys *IOFS) path(name string) string {
+	if name == "." {
+		name = ""
+	}
+	return "/" + name
+}
+
+// stat looks up the io/fs path name on the locked volume.
+func (fsys *IOFS) stat(name string, fno *FILINFO) (FileInfo, FRESULT) {
+	if name == "." {
+		// f_stat does not work on the origin directory.
+		return FileInfo{name: ".", attr: AM_DIR}, FR_OK
+	}
+	fr := fsys.fs.stat(fsys.fs.path(fsys.path(name)), fno)
+	if fr != FR_OK {
+		return FileInfo{}, fr
+	}
+	return newFileInfo(fno, fsys.fs.loc), FR_OK
+}
+
+// validIOFSPath reports whether name is a valid io/fs path that FatFs
+// interprets the same way, i.e: without backslash separators or volume IDs.
+func validIOFSPath(name string) bool {
+	return fs.ValidPath(name) && !strings.ContainsAny(name, `\:`)
+}
+
+type iofsDir struct {
+	fsys *FS
+	dp   DIR
+	info FileInfo
+	eof  bool
+}
+
+func (d *iofsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *iofsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir reads the contents of the directory in directory order, see [fs.ReadDirFile].
+func (d *iofsDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if fr := d.fsys.lock(); fr != FR_OK {
+		return nil, newError("readdir", d.info.name, fr)
+	}
+	defer d.fsys.unlock()
+	var fno FILINFO
+	for !d.eof && (n <= 0 || len(entries) < n) {
+		fr := d.fsys.readdir(&d.dp, &fno)
+		if fr != FR_OK {
+			return entries, newError("readdir", d.info.name, fr)
+		}
+		if fno.fname[0] == 0 {
+			d.eof = true // End of directory.
+			break
+		}
+		entries = append(entries, newFileInfo(&fno, d.fsys.loc))
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+func (d *iofsDir) Close() error {
+	fr := d.fsys.lock()
+	if fr != FR_OK {
+		return newError("close", d.info.name, fr)
+	}
+	defer d.fsys.unlock()
+	fr = d.fsys.closedir(&d.dp)
+	if fr != FR_OK {
+		return newError("close", d.info.name, fr)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package fatfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	fatfs := mustMount(t, newKeylargo())
+	defer fatfs.Close()
+
+	fsys := NewIOFS(fatfs)
+	err := fstest.TestFS(fsys, "rootfile", "rootdir", "rootdir/dirfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(fsys, "rootdir/dirfile")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != dirFileContents {
+		t.Errorf("dirfile contents differ got!=want\n%q\n%q\n", data, dirFileContents)
+	}
+	_, err = fsys.Open("notexist")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want fs.ErrNotExist opening missing file, got %v", err)
+	}
+
+	// Names and errors use io/fs paths, not the paths on the volume.
+	f, err := fsys.Open("rootdir/dirfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := f.(*File).Name(); name != "rootdir/dirfile" {
+		t.Errorf("Name got %q, want %q", name, "rootdir/dirfile")
+	}
+	defer f.Close()
+	w, err := fatfs.OpenFile("/rootfile", FA_WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var ferr *Error
+	if _, err = fsys.Open("rootfile"); !errors.As(err, &ferr) || ferr.Path != "rootfile" {
+		t.Errorf("want error on %q opening a file open for writing, got %v", "rootfile", err)
+	}
+}